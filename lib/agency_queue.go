@@ -4,15 +4,39 @@ import (
     "gopkg.in/dedis/crypto.v0/abstract"
 )
 
+// Ciphertext is an ElGamal encryption of a message.  Messages longer than a
+// single point's embedding capacity are split across several points, each
+// encrypted with its own K.  KeyVersion is the version of the recipient's
+// key the message is encrypted for, 0 if the recipient has no keyring.
 type Ciphertext struct {
-    K   abstract.Point
-    C   abstract.Point
+    K           []abstract.Point
+    C           []abstract.Point
+    KeyVersion  int
 }
 
+// AgencyTriple is a queued query.  Parent is the triple whose reply revealed
+// it, nil for the warrant target, and Weight the weight of the call between
+// them.  Release is the signature with which the parent's telecom released
+// it, under ReleaseKey.  ID is the queried identifier once the agency has
+// decrypted the reply.
 type AgencyTriple struct {
     EncPhone    Ciphertext
     Telecom     int
     Depth       int
+    Parent      *AgencyTriple
+    Weight      int
+    Release     []byte
+    ReleaseKey  abstract.Point
+    ID          string
+}
+
+// Chain returns the identifiers from the warrant target down to this triple
+func (t *AgencyTriple) Chain() []string {
+    var chain []string
+    for n := t; n != nil; n = n.Parent {
+        chain = append([]string{n.ID}, chain...)
+    }
+    return chain
 }
 
 // https://gist.github.com/moraes/2141121
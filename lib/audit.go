@@ -0,0 +1,187 @@
+package lib
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+// AuditRecord is an entry of an audit log.  Every record holds the hash of
+// the record before it and is signed by the node keeping the log, so records
+// cannot be altered, removed or reordered without breaking the chain.
+type AuditRecord struct {
+    Seq         int
+    Time        int64
+    Node        string
+    Event       string
+    Warrant     string
+    Query       int
+    Detail      string
+    Prev        []byte
+    Hash        []byte
+    Signature   []byte
+}
+
+// digest hashes the fields of a record, its predecessor's hash included
+func (r *AuditRecord) digest() []byte {
+    h := sha256.New()
+    fmt.Fprintf(h, "%d|%d|%q|%q|%q|%d|%q|%x", r.Seq, r.Time, r.Node, r.Event, r.Warrant,
+        r.Query, r.Detail, r.Prev)
+    return h.Sum(nil)
+}
+
+// AuditLog is the append-only audit log of a node.  Records are kept in
+// memory and, for a log opened with OpenAuditLog, appended to a file.
+type AuditLog struct {
+    mu          sync.Mutex
+    suite       abstract.Suite
+    private     abstract.Scalar
+    Public      abstract.Point
+    records     []AuditRecord
+    file        *os.File
+}
+
+// NewAuditLog returns an empty audit log signed with the given private key
+func NewAuditLog(suite abstract.Suite, private abstract.Scalar) *AuditLog {
+    return &AuditLog{
+        suite:      suite,
+        private:    private,
+        Public:     suite.Point().Mul(nil, private),
+    }
+}
+
+// OpenAuditLog opens the audit log stored at path, creating it if needed.
+// The records already in the file must verify under the key.
+func OpenAuditLog(path string, suite abstract.Suite, private abstract.Scalar) (*AuditLog, error) {
+    l := NewAuditLog(suite, private)
+
+    file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0600)
+    if err != nil {
+        return nil, err
+    }
+    records, err := ReadAuditRecords(file)
+    if err == nil {
+        err = VerifyAuditRecords(suite, l.Public, records)
+    }
+    if err != nil {
+        file.Close()
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+
+    l.records = records
+    l.file = file
+    return l, nil
+}
+
+// Append adds a signed record to the log and returns it
+func (l *AuditLog) Append(node, event, warrant string, query int, detail string) (AuditRecord, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    r := AuditRecord{
+        Seq:        len(l.records),
+        Time:       time.Now().UnixNano(),
+        Node:       node,
+        Event:      event,
+        Warrant:    warrant,
+        Query:      query,
+        Detail:     detail,
+    }
+    if r.Seq > 0 {
+        r.Prev = l.records[r.Seq - 1].Hash
+    }
+    r.Hash = r.digest()
+    r.Signature = SchnorrSign(l.suite, random.Stream, r.Hash, l.private)
+
+    if l.file != nil {
+        line, err := json.Marshal(&r)
+        if err != nil {
+            return r, err
+        }
+        if _, err := l.file.Write(append(line, '\n')); err != nil {
+            return r, err
+        }
+    }
+    l.records = append(l.records, r)
+    return r, nil
+}
+
+// Records returns a copy of the records of the log
+func (l *AuditLog) Records() []AuditRecord {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return append([]AuditRecord(nil), l.records...)
+}
+
+// Export writes the records of the log, one JSON object per line
+func (l *AuditLog) Export(w io.Writer) error {
+    enc := json.NewEncoder(w)
+    for _, r := range l.Records() {
+        if err := enc.Encode(&r); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Close closes the file of the log, if any
+func (l *AuditLog) Close() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.file == nil {
+        return nil
+    }
+    err := l.file.Close()
+    l.file = nil
+    return err
+}
+
+// ReadAuditRecords reads records written by Export
+func ReadAuditRecords(r io.Reader) ([]AuditRecord, error) {
+    var records []AuditRecord
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+            continue
+        }
+        var record AuditRecord
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            return nil, fmt.Errorf("line %d: %v", lineNum, err)
+        }
+        records = append(records, record)
+    }
+    return records, scanner.Err()
+}
+
+// VerifyAuditRecords checks that records form an unbroken chain from the
+// start of a log, and that every record is signed with the given key
+func VerifyAuditRecords(suite abstract.Suite, public abstract.Point, records []AuditRecord) error {
+    var prev []byte
+    for i := range records {
+        r := &records[i]
+        if r.Seq != i {
+            return fmt.Errorf("record %d: sequence number %d", i, r.Seq)
+        }
+        if !bytes.Equal(r.Prev, prev) {
+            return fmt.Errorf("record %d: broken hash chain", i)
+        }
+        if !bytes.Equal(r.Hash, r.digest()) {
+            return fmt.Errorf("record %d: hash does not match its contents", i)
+        }
+        if err := SchnorrVerify(suite, r.Hash, public, r.Signature); err != nil {
+            return fmt.Errorf("record %d: %v", i, err)
+        }
+        prev = r.Hash
+    }
+    return nil
+}
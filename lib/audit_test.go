@@ -0,0 +1,90 @@
+package lib
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "gopkg.in/dedis/crypto.v0/nist"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+func TestAuditLog(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    key := suite.Scalar().Pick(random.Stream)
+
+    l := NewAuditLog(suite, key)
+    l.Append("telecom0", "query-received", "w1", 1, "depth 2")
+    l.Append("telecom0", "query-answered", "w1", 1, "released 3")
+    l.Append("telecom0", "query-rejected", "w2", 2, "invalid signature")
+
+    records := l.Records()
+    if len(records) != 3 || VerifyAuditRecords(suite, l.Public, records) != nil {
+        panic("ERROR: audit log does not verify")
+    }
+
+    // Exported records read back and verify
+    var buf bytes.Buffer
+    if err := l.Export(&buf); err != nil {
+        panic("ERROR: could not export audit log: " + err.Error())
+    }
+    read, err := ReadAuditRecords(&buf)
+    if err != nil || VerifyAuditRecords(suite, l.Public, read) != nil {
+        panic("ERROR: exported audit log does not verify")
+    }
+
+    // Altering, removing or reordering records breaks the chain
+    altered := append([]AuditRecord(nil), records...)
+    altered[1].Detail = "released 0"
+    if VerifyAuditRecords(suite, l.Public, altered) == nil {
+        panic("ERROR: altered record verified")
+    }
+    if VerifyAuditRecords(suite, l.Public, []AuditRecord{records[0], records[2]}) == nil {
+        panic("ERROR: removed record went unnoticed")
+    }
+    if VerifyAuditRecords(suite, l.Public, []AuditRecord{records[1], records[0], records[2]}) == nil {
+        panic("ERROR: reordered records verified")
+    }
+    other := suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))
+    if VerifyAuditRecords(suite, other, records) == nil {
+        panic("ERROR: records verified under another key")
+    }
+
+    println("PASS: Audit log test")
+}
+
+func TestAuditLogFile(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    key := suite.Scalar().Pick(random.Stream)
+
+    dir, err := ioutil.TempDir("", "ppcc-audit")
+    if err != nil {
+        panic("ERROR: " + err.Error())
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "agency.audit")
+
+    // The log continues across openings of the file
+    for i := 0; i < 2; i++ {
+        l, err := OpenAuditLog(path, suite, key)
+        if err != nil {
+            panic("ERROR: could not open audit log: " + err.Error())
+        }
+        l.Append("agency", "warrant", "w1", 0, "")
+        l.Close()
+    }
+    l, err := OpenAuditLog(path, suite, key)
+    if err != nil || len(l.Records()) != 2 {
+        panic("ERROR: audit log not continued")
+    }
+    l.Close()
+
+    // A log kept under another key is refused
+    if _, err := OpenAuditLog(path, suite, suite.Scalar().Pick(random.Stream)); err == nil {
+        panic("ERROR: audit log opened with another key")
+    }
+
+    println("PASS: Audit log file test")
+}
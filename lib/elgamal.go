@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"errors"
+
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/random"
 )
@@ -21,6 +23,30 @@ func ElGamalEncrypt(suite abstract.Suite, pubkey abstract.Point, message []byte)
 	return
 }
 
+//performs elgamal encryption of a message of any length, embedding it into as
+//many points as needed. Every point keeps the invariant of ElGamalEncrypt
+func ElGamalEncryptMessage(suite abstract.Suite, pubkey abstract.Point, message []byte) (
+	c Ciphertext, err error) {
+
+	if suite.Point().PickLen() <= 0 {
+		return c, errors.New("suite cannot embed data in points")
+	}
+
+	for {
+		K, C, remainder := ElGamalEncrypt(suite, pubkey, message)
+		if len(message) > 0 && len(remainder) >= len(message) {
+			return Ciphertext{}, errors.New("message could not be embedded without loss")
+		}
+		c.K = append(c.K, K)
+		c.C = append(c.C, C)
+
+		message = remainder
+		if len(message) == 0 {
+			return c, nil
+		}
+	}
+}
+
 //performs elgamal encryption of a message
 func NonSeededElGamalEncrypt(suite abstract.Suite, pubkey abstract.Point, message []byte) (
 	K, C abstract.Point, remainder []byte) {
@@ -64,3 +90,21 @@ func PartialElGamalDecrypt(suite abstract.Suite, prikey abstract.Scalar, K, C ab
 	_, err = M.Data()
 	return
 }
+
+//performs elgamal decryption of a (possibly multi-point) ciphertext, output is a message
+func ElGamalDecryptMessage(suite abstract.Suite, prikey abstract.Scalar, c Ciphertext) (
+	message []byte, err error) {
+
+	if len(c.K) == 0 || len(c.K) != len(c.C) {
+		return nil, errors.New("malformed ciphertext")
+	}
+
+	for i := range c.K {
+		part, err := ElGamalDecrypt(suite, prikey, c.K[i], c.C[i])
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, part...)
+	}
+	return message, nil
+}
@@ -27,3 +27,44 @@ func TestElgamal(t *testing.T) {
     println("PASS: El Gamal test")
 
 }
+
+func TestElgamalMessage(t *testing.T) {
+
+	suite := nist.NewAES128SHA256P256()
+
+	a := suite.Scalar().Pick(random.Stream)
+	A := suite.Point().Mul(nil, a)
+
+	// Longer than the embedding capacity of a single P256 point
+	m := []byte("elgamal encryption of a message that does not fit into one point")
+	c, err := ElGamalEncryptMessage(suite, A, m)
+	if err != nil {
+		panic("encryption failed: " + err.Error())
+	}
+	if len(c.K) < 2 || len(c.K) != len(c.C) {
+		panic("message was not split across several points")
+	}
+
+	mm, err := ElGamalDecryptMessage(suite, a, c)
+	if err != nil {
+		panic("decryption failed: " + err.Error())
+	}
+	if string(mm) != string(m) {
+		panic("decryption produced wrong output: " + string(mm))
+	}
+
+	// Identical messages are encoded into identical points
+	c2, _ := ElGamalEncryptMessage(suite, A, m)
+	for i := range c.C {
+		M1 := suite.Point().Sub(c.C[i], suite.Point().Mul(c.K[i], a))
+		M2 := suite.Point().Sub(c2.C[i], suite.Point().Mul(c2.K[i], a))
+		if !M1.Equal(M2) {
+			panic("identical messages encoded into different points")
+		}
+	}
+
+	if _, err := ElGamalDecryptMessage(suite, a, Ciphertext{}); err == nil {
+		panic("empty ciphertext decrypted without error")
+	}
+	println("PASS: El Gamal message test")
+}
@@ -0,0 +1,214 @@
+package lib
+
+import (
+    "bufio"
+    "encoding/csv"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// WriteGraph writes a graph to a TGF file that ReadGraph reads back
+func WriteGraph (path string, graph *TelecomGraph) error {
+    return WriteGraphFormat(path, graph, FormatTGF)
+}
+
+// WriteGraphFormat writes a graph to a file in the given format
+func WriteGraphFormat (path string, graph *TelecomGraph, format GraphFormat) error {
+    var write func(io.Writer, *TelecomGraph) error
+    switch format {
+    case FormatTGF:
+        write = WriteTGF
+    case FormatCSV:
+        write = WriteCSV
+    case FormatGraphML:
+        write = WriteGraphML
+    case FormatEdgeList:
+        write = WriteEdgeList
+    default:
+        return fmt.Errorf("unsupported graph format %v", format)
+    }
+
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := write(file, graph); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// exportEdge is one undirected edge, listed once
+type exportEdge struct {
+    From    AgencyPair
+    To      AgencyPair
+    Weight  int
+}
+
+// sortedNodes lists the nodes of a graph ordered by telecom and identifier
+func sortedNodes(graph *TelecomGraph) []AgencyPair {
+    nodes := make([]AgencyPair, 0, len(graph.Nodes))
+    for node := range graph.Nodes {
+        nodes = append(nodes, node)
+    }
+    sort.Slice(nodes, func(i, j int) bool {
+        if nodes[i].Telecom != nodes[j].Telecom {
+            return nodes[i].Telecom < nodes[j].Telecom
+        }
+        return nodes[i].ID() < nodes[j].ID()
+    })
+    return nodes
+}
+
+// sortedEdges lists every undirected edge once.  AddEdge stores each edge in
+// the adjacency lists of both endpoints (twice in the same list for loops).
+func sortedEdges(graph *TelecomGraph, nodes []AgencyPair) []exportEdge {
+    var edges []exportEdge
+    for _, node := range nodes {
+        loops := 0
+        for _, edge := range graph.Neighbors(node) {
+            if edge.Pair == node {
+                loops++
+                if loops % 2 == 0 {
+                    continue
+                }
+            } else if edge.Pair.ID() < node.ID() {
+                continue
+            }
+            edges = append(edges, exportEdge{node, edge.Pair, edge.Weight})
+        }
+    }
+    return edges
+}
+
+// checkFieldIDs verifies that every identifier can be written as a field of
+// a line-based format: the readers split lines on whitespace and on the
+// separators given, and skip lines starting with '#' or '%'
+func checkFieldIDs (nodes []AgencyPair, separators string) error {
+    for _, node := range nodes {
+        id := node.ID()
+        if id == "" || strings.IndexFunc(id, unicode.IsSpace) >= 0 || strings.ContainsAny(id, separators) ||
+            id[0] == '#' || id[0] == '%' {
+            return fmt.Errorf("identifier %q cannot be written as a field", id)
+        }
+    }
+    return nil
+}
+
+// WriteTGF writes a graph in the TGF format read by ParseTGF.  Identifiers
+// holding whitespace cannot be written.
+func WriteTGF (w io.Writer, graph *TelecomGraph) error {
+    out := bufio.NewWriter(w)
+    nodes := sortedNodes(graph)
+    if err := checkFieldIDs(nodes, ""); err != nil {
+        return err
+    }
+    for _, node := range nodes {
+        fmt.Fprintf(out, "%s %d\n", node.ID(), node.Telecom)
+    }
+    fmt.Fprintln(out, "#")
+    for _, edge := range sortedEdges(graph, nodes) {
+        fmt.Fprintf(out, "%s %s %d\n", edge.From.ID(), edge.To.ID(), edge.Weight)
+    }
+    return out.Flush()
+}
+
+// WriteEdgeList writes one "identifier identifier weight" line per edge.
+// Edge lists cannot hold telecoms or isolated nodes; pass TelecomMap to
+// ImportOptions.Telecoms to restore the telecoms when reading the list back.
+// Identifiers holding whitespace or commas cannot be written.
+func WriteEdgeList (w io.Writer, graph *TelecomGraph) error {
+    out := bufio.NewWriter(w)
+    nodes := sortedNodes(graph)
+    if err := checkFieldIDs(nodes, ","); err != nil {
+        return err
+    }
+    for _, edge := range sortedEdges(graph, nodes) {
+        fmt.Fprintf(out, "%s %s %d\n", edge.From.ID(), edge.To.ID(), edge.Weight)
+    }
+    return out.Flush()
+}
+
+// csvExportMapping is the mapping that reads a file written by WriteCSV
+var csvExportMapping = CSVMapping{
+    Caller:         "caller",
+    Callee:         "callee",
+    CallerTelecom:  "caller_telecom",
+    CalleeTelecom:  "callee_telecom",
+    Weight:         "weight",
+}
+
+// CSVExportMapping returns the CSVMapping matching the columns of WriteCSV
+func CSVExportMapping() CSVMapping {
+    return csvExportMapping
+}
+
+// WriteCSV writes one row per edge with the telecoms of both endpoints and
+// the edge weight.  Isolated nodes are not written.
+func WriteCSV (w io.Writer, graph *TelecomGraph) error {
+    out := csv.NewWriter(w)
+    m := csvExportMapping
+    out.Write([]string{m.Caller, m.Callee, m.CallerTelecom, m.CalleeTelecom, m.Weight})
+    for _, edge := range sortedEdges(graph, sortedNodes(graph)) {
+        out.Write([]string{
+            edge.From.ID(),
+            edge.To.ID(),
+            strconv.Itoa(edge.From.Telecom),
+            strconv.Itoa(edge.To.Telecom),
+            strconv.Itoa(edge.Weight),
+        })
+    }
+    out.Flush()
+    return out.Error()
+}
+
+// WriteGraphML writes a graph as an undirected GraphML document with the
+// attributes ParseGraphML reads by default
+func WriteGraphML (w io.Writer, graph *TelecomGraph) error {
+    nodes := sortedNodes(graph)
+    ids := make(map[AgencyPair]string)
+    doc := struct {
+        XMLName xml.Name        `xml:"graphml"`
+        XMLNS   string          `xml:"xmlns,attr"`
+        Keys    []graphMLKey    `xml:"key"`
+        Graph   graphMLGraph    `xml:"graph"`
+    }{
+        XMLNS: "http://graphml.graphdrawing.org/xmlns",
+        Keys: []graphMLKey{
+            {ID: "identifier", For: "node", Name: "identifier", Type: "string"},
+            {ID: "telecom", For: "node", Name: "telecom", Type: "int"},
+            {ID: "weight", For: "edge", Name: "weight", Type: "int"},
+        },
+        Graph: graphMLGraph{EdgeDefault: "undirected"},
+    }
+
+    for i, node := range nodes {
+        ids[node] = "n" + strconv.Itoa(i)
+        doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ids[node], []graphMLData{
+            {"identifier", node.ID()},
+            {"telecom", strconv.Itoa(node.Telecom)},
+        }})
+    }
+    for _, edge := range sortedEdges(graph, nodes) {
+        doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{ids[edge.From], ids[edge.To],
+            []graphMLData{{"weight", strconv.Itoa(edge.Weight)}}})
+    }
+
+    if _, err := io.WriteString(w, xml.Header); err != nil {
+        return err
+    }
+    enc := xml.NewEncoder(w)
+    enc.Indent("", "  ")
+    if err := enc.Encode(doc); err != nil {
+        return err
+    }
+    _, err := io.WriteString(w, "\n")
+    return err
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// sameGraph reports whether two graphs have the same nodes and edges
+func sameGraph(g1, g2 *TelecomGraph) bool {
+    if len(g1.Nodes) != len(g2.Nodes) {
+        return false
+    }
+    for node := range g1.Nodes {
+        if !g2.ContainsNode(node) || len(g1.Neighbors(node)) != len(g2.Neighbors(node)) {
+            return false
+        }
+        for _, edge := range g1.Neighbors(node) {
+            found := false
+            for _, other := range g2.Neighbors(node) {
+                if other == edge {
+                    found = true
+                }
+            }
+            if !found {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func TestGraphRoundTrip(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ppcc-graphs")
+    if err != nil {
+        panic(err)
+    }
+    defer os.RemoveAll(dir)
+
+    files := []string{
+        "../simulation/graph0.tgf",
+        "../simulation/graph1.tgf",
+        "../simulation/graph2.tgf",
+        "tgf_identifiers.tgf",
+    }
+    formats := []GraphFormat{FormatTGF, FormatCSV, FormatGraphML, FormatEdgeList}
+
+    for _, file := range files {
+        graph, err := ReadGraph(file)
+        if err != nil {
+            panic("ERROR: could not read graph: " + err.Error())
+        }
+
+        opts := &ImportOptions{Telecoms: graph.TelecomMap(), CSV: CSVExportMapping()}
+        for _, format := range formats {
+            path := filepath.Join(dir, filepath.Base(file) + "." + format.String())
+            if err := WriteGraphFormat(path, graph, format); err != nil {
+                panic("ERROR: could not write graph: " + err.Error())
+            }
+
+            read, err := ReadGraphFormat(path, format, opts)
+            if err != nil {
+                panic("ERROR: could not read back graph: " + err.Error())
+            }
+            if !sameGraph(graph, read) {
+                panic("ERROR: " + format.String() + " round trip changed " + file)
+            }
+        }
+    }
+
+    // Identifiers the line-based readers would split are not written
+    graph := NewGraph([]AgencyPair{NewPair("email:john doe@example.org", 0), NewPair("1234567890", 0)})
+    for _, write := range []func(io.Writer, *TelecomGraph) error{WriteTGF, WriteEdgeList} {
+        if write(ioutil.Discard, graph) == nil {
+            panic("ERROR: identifier with whitespace written")
+        }
+    }
+
+    println("PASS: Graph round trip test")
+}
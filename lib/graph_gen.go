@@ -0,0 +1,204 @@
+package lib
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sort"
+)
+
+// GeneratorConfig describes a synthetic multi-carrier call graph.  Degrees
+// follow a power law (Chung-Lu model), subscribers are grouped into
+// communities that most calls stay within, and each subscriber belongs to
+// one of the carriers.
+type GeneratorConfig struct {
+    Nodes               int         // subscribers over all carriers
+    Carriers            int
+    AvgDegree           float64     // mean number of contacts per subscriber
+    Exponent            float64     // degree distribution exponent, > 2 (default 2.5)
+    Communities         int         // default: one per 500 subscribers
+    CommunityFraction   float64     // share of calls inside a community
+    CrossCarrierFraction float64    // share of calls between different carriers
+    Seed                int64
+}
+
+// generatorAttempts bounds the rejection sampling of a call's callee
+var generatorAttempts = 64
+
+func (cfg *GeneratorConfig) validate() error {
+    if cfg.Nodes < 2 || cfg.Carriers < 1 {
+        return errors.New("generator needs at least two nodes and one carrier")
+    }
+    if cfg.AvgDegree <= 0 || cfg.AvgDegree >= float64(cfg.Nodes) {
+        return fmt.Errorf("average degree %v out of range", cfg.AvgDegree)
+    }
+    if cfg.Exponent == 0 {
+        cfg.Exponent = 2.5
+    }
+    if cfg.Exponent <= 2 {
+        return fmt.Errorf("degree exponent %v must be larger than 2", cfg.Exponent)
+    }
+    if cfg.Communities <= 0 {
+        cfg.Communities = (cfg.Nodes + 499) / 500
+    }
+    if cfg.Communities > cfg.Nodes {
+        cfg.Communities = cfg.Nodes
+    }
+    if cfg.CommunityFraction < 0 || cfg.CommunityFraction > 1 ||
+       cfg.CrossCarrierFraction < 0 || cfg.CrossCarrierFraction > 1 {
+        return errors.New("generator fractions must be between 0 and 1")
+    }
+    if cfg.Carriers == 1 && cfg.CrossCarrierFraction > 0 {
+        return errors.New("cross-carrier calls need more than one carrier")
+    }
+    return nil
+}
+
+// GeneratedPhone is the phone number given to the i-th generated subscriber
+func GeneratedPhone(i int) string {
+    return fmt.Sprintf("%010d", 2000000000 + i)
+}
+
+// GenerateGraphs builds a synthetic call graph and splits it into one
+// TelecomGraph per carrier.  The graph of a carrier holds its subscribers,
+// their contacts at other carriers and every call involving its subscribers,
+// the same layout as the hand-written simulation graphs.  Repeated calls
+// between two subscribers add to the weight of their edge.
+func GenerateGraphs(cfg GeneratorConfig) ([]*TelecomGraph, error) {
+    if err := cfg.validate(); err != nil {
+        return nil, err
+    }
+    rng := rand.New(rand.NewSource(cfg.Seed))
+    n := cfg.Nodes
+
+    // Expected degrees w_i ~ i^(-1/(exponent-1)), shuffled over the
+    // subscribers so hubs land in random communities and carriers
+    weights := make([]float64, n)
+    total := 0.0
+    for i := range weights {
+        weights[i] = math.Pow(float64(i + 1), -1 / (cfg.Exponent - 1))
+        total += weights[i]
+    }
+    rng.Shuffle(n, func(i, j int) { weights[i], weights[j] = weights[j], weights[i] })
+
+    // Cumulative weights, so subscribers in [lo, hi) are sampled with a
+    // binary search; communities are contiguous ranges of subscribers
+    cumulative := make([]float64, n)
+    sum := 0.0
+    for i, w := range weights {
+        sum += w * cfg.AvgDegree * float64(n) / total
+        cumulative[i] = sum
+    }
+    community := func(i int) (int, int) {
+        c := i * cfg.Communities / n
+        lo := (c * n + cfg.Communities - 1) / cfg.Communities
+        hi := ((c + 1) * n + cfg.Communities - 1) / cfg.Communities
+        return lo, hi
+    }
+    sample := func(lo, hi int) int {
+        base := 0.0
+        if lo > 0 {
+            base = cumulative[lo - 1]
+        }
+        r := base + rng.Float64() * (cumulative[hi - 1] - base)
+        i := sort.SearchFloat64s(cumulative[lo:hi], r) + lo
+        if i >= hi {
+            i = hi - 1
+        }
+        return i
+    }
+
+    carriers := make([]int, n)
+    for i := range carriers {
+        carriers[i] = rng.Intn(cfg.Carriers)
+    }
+
+    // Place the calls, merging repeated calls into one weighted edge
+    numEdges := int(cfg.AvgDegree * float64(n) / 2)
+    calls := make(map[uint64]int, numEdges)
+    var order []uint64
+    for e := 0; e < numEdges; e++ {
+        caller := sample(0, n)
+        lo, hi := 0, n
+        if rng.Float64() < cfg.CommunityFraction {
+            lo, hi = community(caller)
+        }
+        cross := rng.Float64() < cfg.CrossCarrierFraction
+
+        callee := -1
+        for attempt := 0; attempt < generatorAttempts; attempt++ {
+            c := sample(lo, hi)
+            if c != caller && (carriers[c] != carriers[caller]) == cross {
+                callee = c
+                break
+            }
+        }
+        if callee < 0 {
+            continue
+        }
+
+        u, v := uint64(caller), uint64(callee)
+        if v < u {
+            u, v = v, u
+        }
+        key := u * uint64(n) + v
+        if calls[key] == 0 {
+            order = append(order, key)
+        }
+        calls[key]++
+    }
+
+    // Split into one graph per carrier; a subscriber is added to another
+    // carrier's graph the first time it calls one of its subscribers
+    graphs := make([]*TelecomGraph, cfg.Carriers)
+    for c := range graphs {
+        graphs[c] = NewGraph(nil)
+    }
+    pairs := make([]AgencyPair, n)
+    for i := range pairs {
+        pairs[i] = AgencyPair{GeneratedPhone(i), carriers[i], KindPhone}
+        graphs[carriers[i]].AddNode(pairs[i])
+    }
+    foreign := make(map[[2]int]bool)
+    for _, key := range order {
+        u, v := int(key / uint64(n)), int(key % uint64(n))
+        g := graphs[carriers[u]]
+        g.Graph[pairs[u]] = append(g.Graph[pairs[u]], Edge{pairs[v], calls[key]})
+        g.Graph[pairs[v]] = append(g.Graph[pairs[v]], Edge{pairs[u], calls[key]})
+        if carriers[u] == carriers[v] {
+            continue
+        }
+
+        g2 := graphs[carriers[v]]
+        g2.Graph[pairs[u]] = append(g2.Graph[pairs[u]], Edge{pairs[v], calls[key]})
+        g2.Graph[pairs[v]] = append(g2.Graph[pairs[v]], Edge{pairs[u], calls[key]})
+        for _, in := range [2][2]int{{carriers[u], v}, {carriers[v], u}} {
+            if !foreign[in] {
+                foreign[in] = true
+                graphs[in[0]].AddNode(pairs[in[1]])
+            }
+        }
+    }
+
+    return graphs, nil
+}
+
+// WriteGraphs writes one file per carrier graph, named graph<i> with the
+// extension of the format, and returns the paths written
+func WriteGraphs(dir string, graphs []*TelecomGraph, format GraphFormat) ([]string, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    paths := make([]string, len(graphs))
+    for i, graph := range graphs {
+        paths[i] = filepath.Join(dir, fmt.Sprintf("graph%d.%s", i, format))
+        if err := WriteGraphFormat(paths[i], graph, format); err != nil {
+            return nil, err
+        }
+    }
+    return paths, nil
+}
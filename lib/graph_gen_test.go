@@ -0,0 +1,69 @@
+package lib
+
+import (
+    "testing"
+)
+
+func TestGenerateGraphs(t *testing.T) {
+    cfg := GeneratorConfig{
+        Nodes:                  3000,
+        Carriers:               3,
+        AvgDegree:              6,
+        CommunityFraction:      0.8,
+        CrossCarrierFraction:   0.3,
+        Seed:                   1,
+    }
+
+    graphs, err := GenerateGraphs(cfg)
+    if err != nil {
+        panic("ERROR: generation failed: " + err.Error())
+    }
+    if len(graphs) != cfg.Carriers {
+        panic("ERROR: expected one graph per carrier")
+    }
+
+    own, edges, cross, maxDegree := 0, 0, 0, 0
+    for c, graph := range graphs {
+        for node := range graph.Nodes {
+            if node.Telecom != c {
+                continue
+            }
+            own++
+            neighbors := graph.Neighbors(node)
+            if len(neighbors) > maxDegree {
+                maxDegree = len(neighbors)
+            }
+            for _, edge := range neighbors {
+                edges++
+                if edge.Pair.Telecom != c {
+                    cross++
+                    // Calls between carriers appear in both carriers' graphs
+                    if !graphs[edge.Pair.Telecom].ContainsEdge(edge.Pair, node) {
+                        panic("ERROR: cross-carrier edge missing from other carrier")
+                    }
+                }
+            }
+        }
+    }
+
+    if own != cfg.Nodes {
+        panic("ERROR: every subscriber must belong to exactly one carrier")
+    }
+    share := float64(cross) / float64(edges)
+    if share < 0.2 || share > 0.4 {
+        panic("ERROR: cross-carrier share far from configured fraction")
+    }
+    if maxDegree < 10 * int(cfg.AvgDegree) {
+        panic("ERROR: degree distribution has no hubs")
+    }
+
+    // The same seed generates the same graphs
+    again, _ := GenerateGraphs(cfg)
+    for c := range graphs {
+        if !sameGraph(graphs[c], again[c]) {
+            panic("ERROR: generation is not deterministic")
+        }
+    }
+
+    println("PASS: Graph generator test")
+}
@@ -0,0 +1,533 @@
+package lib
+
+import (
+    "bufio"
+    "encoding/csv"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// GraphFormat is a file format a TelecomGraph can be read from
+type GraphFormat int
+
+const (
+    FormatTGF GraphFormat = iota
+    FormatCSV
+    FormatGraphML
+    FormatEdgeList
+)
+
+var formatNames = [...]string{"tgf", "csv", "graphml", "edgelist"}
+
+func (f GraphFormat) String() string {
+    if f < 0 || int(f) >= len(formatNames) {
+        return fmt.Sprintf("format(%d)", int(f))
+    }
+    return formatNames[f]
+}
+
+// ParseGraphFormat returns the format with the given name
+func ParseGraphFormat(name string) (GraphFormat, error) {
+    for i, n := range formatNames {
+        if n == strings.ToLower(name) {
+            return GraphFormat(i), nil
+        }
+    }
+    return FormatTGF, fmt.Errorf("unknown graph format %q", name)
+}
+
+// FormatFromPath guesses the format of a graph file from its extension
+func FormatFromPath(path string) (GraphFormat, error) {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".tgf":
+        return FormatTGF, nil
+    case ".csv", ".cdr":
+        return FormatCSV, nil
+    case ".graphml", ".xml":
+        return FormatGraphML, nil
+    case ".edges", ".edgelist", ".txt":
+        return FormatEdgeList, nil
+    }
+    return FormatTGF, fmt.Errorf("cannot tell graph format of %s", path)
+}
+
+// CSVMapping names the columns of a call detail record export.  Columns are
+// matched against the header row, or are zero-based indexes when NoHeader is
+// set.  Empty names default to caller, callee, timestamp and duration (or
+// columns 0 to 3); the telecom columns are optional.
+type CSVMapping struct {
+    Caller          string
+    Callee          string
+    CallerTelecom   string
+    CalleeTelecom   string
+    Timestamp       string
+    Duration        string
+
+    // Optional column holding a precomputed edge weight, as written by WriteCSV
+    Weight          string
+
+    NoHeader        bool
+    Comma           rune
+    TimeLayout      string
+
+    // Only records in [Since, Until) are imported; zero values are unbounded.
+    // A window needs the timestamp column.
+    Since           time.Time
+    Until           time.Time
+
+    // Weight edges by total call duration in seconds instead of call count
+    WeightByDuration bool
+}
+
+// GraphMLMapping names the GraphML attributes holding the node and edge
+// fields.  Nodes without an identifier attribute use their id.
+type GraphMLMapping struct {
+    Identifier  string
+    Telecom     string
+    Weight      string
+}
+
+// ImportOptions configures the importers.  Formats that do not record
+// telecoms take them from Telecoms, falling back to DefaultTelecom.
+type ImportOptions struct {
+    DefaultTelecom  int
+    Telecoms        map[string]int
+    CSV             CSVMapping
+    GraphML         GraphMLMapping
+}
+
+// ReadGraphFormat reads a graph file in the given format; opts may be nil
+func ReadGraphFormat (path string, format GraphFormat, opts *ImportOptions) (*TelecomGraph, error) {
+    if opts == nil {
+        opts = &ImportOptions{}
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    switch format {
+    case FormatTGF:
+        graph, _, err := ParseTGF(file, path, true)
+        return graph, err
+    case FormatCSV:
+        return ParseCSV(file, path, opts)
+    case FormatGraphML:
+        return ParseGraphML(file, path, opts)
+    case FormatEdgeList:
+        return ParseEdgeList(file, path, opts)
+    }
+    return nil, fmt.Errorf("unsupported graph format %v", format)
+}
+
+// graphBuilder collects nodes and aggregated edges in input order
+type graphBuilder struct {
+    name        string
+    opts        *ImportOptions
+    telecoms    map[string]int
+    nodes       []AgencyPair
+    weights     map[[2]string]int
+    edges       [][2]string
+}
+
+func newGraphBuilder(name string, opts *ImportOptions) *graphBuilder {
+    return &graphBuilder{
+        name:       name,
+        opts:       opts,
+        telecoms:   make(map[string]int),
+        weights:    make(map[[2]string]int),
+    }
+}
+
+// node declares an identifier; telecom < 0 looks it up in the options
+func (b *graphBuilder) node(id string, telecom int, line int) (string, error) {
+    pair := NewPair(id, 0)
+    id = pair.ID()
+    if telecom < 0 {
+        if t, ok := b.opts.Telecoms[id]; ok {
+            telecom = t
+        } else {
+            telecom = b.opts.DefaultTelecom
+        }
+    }
+
+    if t, ok := b.telecoms[id]; ok {
+        if t != telecom {
+            return "", &ParseError{b.name, line,
+                fmt.Sprintf("node %s assigned to telecoms %d and %d", id, t, telecom)}
+        }
+        return id, nil
+    }
+
+    pair.Telecom = telecom
+    b.telecoms[id] = telecom
+    b.nodes = append(b.nodes, pair)
+    return id, nil
+}
+
+// edge adds weight to the undirected edge between two declared nodes
+func (b *graphBuilder) edge(id1, id2 string, weight int) {
+    if id1 == id2 {
+        return
+    }
+    if id2 < id1 {
+        id1, id2 = id2, id1
+    }
+    key := [2]string{id1, id2}
+    if _, ok := b.weights[key]; !ok {
+        b.edges = append(b.edges, key)
+    }
+    b.weights[key] += weight
+}
+
+func (b *graphBuilder) graph() *TelecomGraph {
+    graph := NewGraph(b.nodes)
+    for _, key := range b.edges {
+        graph.AddEdge(NewPair(key[0], b.telecoms[key[0]]), NewPair(key[1], b.telecoms[key[1]]),
+            b.weights[key])
+    }
+    return graph
+}
+
+// ParseCSV reads call detail records, one call per row.  Every caller/callee
+// pair becomes an edge weighted by the number of calls (or their duration).
+func ParseCSV (r io.Reader, name string, opts *ImportOptions) (*TelecomGraph, error) {
+    m := opts.CSV
+    defaults := [4]string{"caller", "callee", "timestamp", "duration"}
+    if m.NoHeader {
+        defaults = [4]string{"0", "1", "2", "3"}
+    }
+    if m.Caller == "" { m.Caller = defaults[0] }
+    if m.Callee == "" { m.Callee = defaults[1] }
+    if m.Timestamp == "" { m.Timestamp = defaults[2] }
+    if m.Duration == "" { m.Duration = defaults[3] }
+    if m.TimeLayout == "" { m.TimeLayout = time.RFC3339 }
+
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+    reader.TrimLeadingSpace = true
+    if m.Comma != 0 {
+        reader.Comma = m.Comma
+    }
+
+    var header []string
+    lineNo := 0
+    if !m.NoHeader {
+        record, err := reader.Read()
+        if err != nil {
+            return nil, &ParseError{name, 1, "missing header: " + err.Error()}
+        }
+        header = record
+        lineNo++
+    }
+
+    // Resolve column names to indexes; optional columns may be missing
+    column := func(col string, required bool) (int, error) {
+        if col == "" {
+            return -1, nil
+        }
+        if m.NoHeader {
+            idx, err := strconv.Atoi(col)
+            if err != nil || idx < 0 {
+                if !required {
+                    return -1, nil
+                }
+                return -1, fmt.Errorf("column %q is not an index", col)
+            }
+            return idx, nil
+        }
+        for i, h := range header {
+            if strings.EqualFold(strings.TrimSpace(h), col) {
+                return i, nil
+            }
+        }
+        if required {
+            return -1, &ParseError{name, 1, fmt.Sprintf("header has no column %q", col)}
+        }
+        return -1, nil
+    }
+
+    caller, err := column(m.Caller, true)
+    if err != nil { return nil, err }
+    callee, err := column(m.Callee, true)
+    if err != nil { return nil, err }
+    callerTelecom, _ := column(m.CallerTelecom, false)
+    calleeTelecom, _ := column(m.CalleeTelecom, false)
+    window := !m.Since.IsZero() || !m.Until.IsZero()
+    timestamp, err := column(m.Timestamp, window)
+    if err != nil { return nil, err }
+    if window && timestamp < 0 {
+        return nil, fmt.Errorf("%s: a time window needs a timestamp column", name)
+    }
+    duration, _ := column(m.Duration, m.WeightByDuration)
+    if m.WeightByDuration && duration < 0 {
+        return nil, fmt.Errorf("%s: weighting by duration needs a duration column", name)
+    }
+    weightColumn, err := column(m.Weight, m.Weight != "")
+    if err != nil { return nil, err }
+
+    builder := newGraphBuilder(name, opts)
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        lineNo++
+        if err != nil {
+            return nil, &ParseError{name, lineNo, err.Error()}
+        }
+
+        field := func(idx int) (string, error) {
+            if idx < 0 {
+                return "", nil
+            }
+            if idx >= len(record) {
+                return "", &ParseError{name, lineNo, fmt.Sprintf("missing column %d", idx)}
+            }
+            return strings.TrimSpace(record[idx]), nil
+        }
+        telecomField := func(idx int) (int, error) {
+            s, err := field(idx)
+            if err != nil || s == "" {
+                return -1, err
+            }
+            telecom, err := strconv.Atoi(s)
+            if err != nil || telecom < 0 {
+                return -1, &ParseError{name, lineNo, fmt.Sprintf("invalid telecom %q", s)}
+            }
+            return telecom, nil
+        }
+
+        // Skip calls outside the requested time window
+        if window {
+            s, err := field(timestamp)
+            if err != nil {
+                return nil, err
+            }
+            when, err := time.Parse(m.TimeLayout, s)
+            if err != nil {
+                return nil, &ParseError{name, lineNo, fmt.Sprintf("invalid timestamp %q", s)}
+            }
+            if (!m.Since.IsZero() && when.Before(m.Since)) || (!m.Until.IsZero() && !when.Before(m.Until)) {
+                continue
+            }
+        }
+
+        weight := 1
+        if m.WeightByDuration {
+            s, err := field(duration)
+            if err != nil {
+                return nil, err
+            }
+            seconds, err := strconv.ParseFloat(s, 64)
+            if err != nil || seconds < 0 {
+                return nil, &ParseError{name, lineNo, fmt.Sprintf("invalid duration %q", s)}
+            }
+            weight = int(seconds + 0.5)
+        }
+        if weightColumn >= 0 {
+            s, err := field(weightColumn)
+            if err != nil {
+                return nil, err
+            }
+            w, err := strconv.Atoi(s)
+            if err != nil || w < 0 {
+                return nil, &ParseError{name, lineNo, fmt.Sprintf("invalid weight %q", s)}
+            }
+            weight = w
+        }
+
+        ids := [2]string{}
+        for i, cols := range [2][2]int{{caller, callerTelecom}, {callee, calleeTelecom}} {
+            id, err := field(cols[0])
+            if err != nil {
+                return nil, err
+            }
+            if id == "" {
+                return nil, &ParseError{name, lineNo, "empty caller or callee"}
+            }
+            telecom, err := telecomField(cols[1])
+            if err != nil {
+                return nil, err
+            }
+            if ids[i], err = builder.node(id, telecom, lineNo); err != nil {
+                return nil, err
+            }
+        }
+        builder.edge(ids[0], ids[1], weight)
+    }
+
+    return builder.graph(), nil
+}
+
+// ParseEdgeList reads "identifier identifier [weight]" lines; blank lines and
+// lines starting with '#' or '%' are ignored and weights default to 1.
+func ParseEdgeList (r io.Reader, name string, opts *ImportOptions) (*TelecomGraph, error) {
+    builder := newGraphBuilder(name, opts)
+    scanner := bufio.NewScanner(r)
+    lineNo := 0
+
+    for scanner.Scan() {
+        lineNo++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || line[0] == '#' || line[0] == '%' {
+            continue
+        }
+
+        data := strings.FieldsFunc(line, func(c rune) bool {
+            return c == ' ' || c == '\t' || c == ','
+        })
+        if len(data) != 2 && len(data) != 3 {
+            return nil, &ParseError{name, lineNo,
+                fmt.Sprintf("expected \"identifier identifier [weight]\", got %d fields", len(data))}
+        }
+
+        weight := 1
+        if len(data) == 3 {
+            w, err := strconv.Atoi(data[2])
+            if err != nil || w < 0 {
+                return nil, &ParseError{name, lineNo, fmt.Sprintf("invalid weight %q", data[2])}
+            }
+            weight = w
+        }
+
+        id1, err := builder.node(data[0], -1, lineNo)
+        if err != nil {
+            return nil, err
+        }
+        id2, err := builder.node(data[1], -1, lineNo)
+        if err != nil {
+            return nil, err
+        }
+        builder.edge(id1, id2, weight)
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, &ParseError{name, lineNo + 1, err.Error()}
+    }
+    return builder.graph(), nil
+}
+
+type graphML struct {
+    Keys    []graphMLKey    `xml:"key"`
+    Graphs  []graphMLGraph  `xml:"graph"`
+}
+
+type graphMLKey struct {
+    ID      string  `xml:"id,attr"`
+    For     string  `xml:"for,attr"`
+    Name    string  `xml:"attr.name,attr"`
+    Type    string  `xml:"attr.type,attr,omitempty"`
+}
+
+type graphMLGraph struct {
+    EdgeDefault string          `xml:"edgedefault,attr"`
+    Nodes       []graphMLNode   `xml:"node"`
+    Edges       []graphMLEdge   `xml:"edge"`
+}
+
+type graphMLNode struct {
+    ID      string          `xml:"id,attr"`
+    Data    []graphMLData   `xml:"data"`
+}
+
+type graphMLEdge struct {
+    Source  string          `xml:"source,attr"`
+    Target  string          `xml:"target,attr"`
+    Data    []graphMLData   `xml:"data"`
+}
+
+type graphMLData struct {
+    Key     string  `xml:"key,attr"`
+    Value   string  `xml:",chardata"`
+}
+
+// ParseGraphML reads the first graph of a GraphML document.  Directed
+// graphs are read as undirected ones.
+func ParseGraphML (r io.Reader, name string, opts *ImportOptions) (*TelecomGraph, error) {
+    m := opts.GraphML
+    if m.Identifier == "" { m.Identifier = "identifier" }
+    if m.Telecom == "" { m.Telecom = "telecom" }
+    if m.Weight == "" { m.Weight = "weight" }
+
+    var doc graphML
+    if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+        return nil, fmt.Errorf("%s: %v", name, err)
+    }
+    if len(doc.Graphs) == 0 {
+        return nil, fmt.Errorf("%s: no graph element", name)
+    }
+
+    // Map attribute names to the key ids used by data elements
+    keys := make(map[string]string)
+    for _, k := range doc.Keys {
+        keys[k.For + "/" + k.Name] = k.ID
+    }
+    value := func(data []graphMLData, kind, attr string) (string, bool) {
+        id, ok := keys[kind + "/" + attr]
+        if !ok {
+            id, ok = keys["all/" + attr]
+        }
+        for _, d := range data {
+            if ok && d.Key == id {
+                return strings.TrimSpace(d.Value), true
+            }
+        }
+        return "", false
+    }
+
+    builder := newGraphBuilder(name, opts)
+    ids := make(map[string]string)
+    g := doc.Graphs[0]
+    for _, n := range g.Nodes {
+        id, ok := value(n.Data, "node", m.Identifier)
+        if !ok {
+            id = n.ID
+        }
+
+        telecom := -1
+        if s, ok := value(n.Data, "node", m.Telecom); ok {
+            t, err := strconv.Atoi(s)
+            if err != nil || t < 0 {
+                return nil, fmt.Errorf("%s: node %s: invalid telecom %q", name, n.ID, s)
+            }
+            telecom = t
+        }
+
+        if _, ok := ids[n.ID]; ok {
+            return nil, fmt.Errorf("%s: duplicate node %s", name, n.ID)
+        }
+        var err error
+        if ids[n.ID], err = builder.node(id, telecom, 0); err != nil {
+            return nil, fmt.Errorf("%s: %s", name, err.(*ParseError).Msg)
+        }
+    }
+
+    for _, e := range g.Edges {
+        id1, ok1 := ids[e.Source]
+        id2, ok2 := ids[e.Target]
+        if !ok1 || !ok2 {
+            return nil, fmt.Errorf("%s: edge %s-%s refers to undeclared node", name, e.Source, e.Target)
+        }
+
+        weight := 1
+        if s, ok := value(e.Data, "edge", m.Weight); ok {
+            w, err := strconv.Atoi(s)
+            if err != nil || w < 0 {
+                return nil, fmt.Errorf("%s: edge %s-%s: invalid weight %q", name, e.Source, e.Target, s)
+            }
+            weight = w
+        }
+        builder.edge(id1, id2, weight)
+    }
+
+    return builder.graph(), nil
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCSVImport(t *testing.T) {
+    input := "Callee,Caller,Start,Seconds,CallerNet\n" +
+             "1234567891,1234567890,2017-03-01T10:00:00Z,60,0\n" +
+             "1234567891,1234567890,2017-03-02T10:00:00Z,30,0\n" +
+             "imsi:310150123456789,1234567891,2017-03-03T10:00:00Z,10,1\n" +
+             "1234567892,1234567890,2017-04-01T10:00:00Z,5,0\n"
+
+    opts := &ImportOptions{
+        DefaultTelecom: 1,
+        CSV: CSVMapping{
+            Caller:           "caller",
+            Callee:           "callee",
+            CallerTelecom:    "callernet",
+            Timestamp:        "start",
+            Duration:         "seconds",
+            Until:            time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+            WeightByDuration: true,
+        },
+    }
+
+    graph, err := ParseCSV(strings.NewReader(input), "calls.csv", opts)
+    if err != nil {
+        panic("ERROR: CSV import failed: " + err.Error())
+    }
+
+    n0 := AgencyPair{"1234567890", 0, KindPhone}
+    n1 := AgencyPair{"1234567891", 1, KindPhone}
+    n2 := AgencyPair{"310150123456789", 1, KindIMSI}
+    if graph.NumNodes != 3 || !graph.ContainsNode(n0) || !graph.ContainsNode(n1) || !graph.ContainsNode(n2) {
+        panic("ERROR: CSV import produced wrong nodes")
+    }
+    if !graph.ContainsEdge(n0, n1) || !graph.ContainsEdge(n1, n2) {
+        panic("ERROR: CSV import produced wrong edges")
+    }
+    if len(graph.Neighbors(n0)) != 1 || graph.Neighbors(n0)[0].Weight != 90 {
+        panic("ERROR: CSV import did not aggregate call durations")
+    }
+
+    // A number cannot belong to two telecoms
+    bad := "caller,callee,callernet\n1234567890,1234567891,0\n1234567890,1234567892,2\n"
+    _, err = ParseCSV(strings.NewReader(bad), "bad.csv", &ImportOptions{CSV: CSVMapping{CallerTelecom: "callernet"}})
+    if err == nil || !strings.HasPrefix(err.Error(), "bad.csv:3:") {
+        panic("ERROR: conflicting telecoms not reported")
+    }
+
+    // A time window cannot be applied without the timestamp column
+    opts.CSV.Timestamp = "time"
+    if _, err = ParseCSV(strings.NewReader(input), "calls.csv", opts); err == nil {
+        panic("ERROR: time window ignored without a timestamp column")
+    }
+
+    println("PASS: CSV import test")
+}
+
+func TestEdgeListImport(t *testing.T) {
+    input := "# carrier export\n1234567890 1234567891\n1234567891\t1234567892\t4\n" +
+             "1234567891,1234567890,2\n"
+    opts := &ImportOptions{Telecoms: map[string]int{"1234567892": 2}}
+
+    graph, err := ParseEdgeList(strings.NewReader(input), "calls.edges", opts)
+    if err != nil {
+        panic("ERROR: edge list import failed: " + err.Error())
+    }
+
+    n0 := AgencyPair{"1234567890", 0, KindPhone}
+    n1 := AgencyPair{"1234567891", 0, KindPhone}
+    n2 := AgencyPair{"1234567892", 2, KindPhone}
+    if !graph.ContainsEdge(n0, n1) || !graph.ContainsEdge(n2, n1) {
+        panic("ERROR: edge list import produced wrong edges")
+    }
+    if graph.Neighbors(n0)[0].Weight != 3 {
+        panic("ERROR: edge list import did not aggregate weights")
+    }
+
+    _, err = ParseEdgeList(strings.NewReader("1234567890 1234567891 x\n"), "bad.edges", opts)
+    if err == nil || err.Error() != "bad.edges:1: invalid weight \"x\"" {
+        panic("ERROR: bad weight not reported")
+    }
+
+    println("PASS: Edge list import test")
+}
+
+func TestGraphMLImport(t *testing.T) {
+    input := `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="d0" for="node" attr.name="identifier" attr.type="string"/>
+  <key id="d1" for="node" attr.name="telecom" attr.type="int"/>
+  <key id="d2" for="edge" attr.name="weight" attr.type="int"/>
+  <graph edgedefault="undirected">
+    <node id="n0"><data key="d0">1234567890</data><data key="d1">0</data></node>
+    <node id="n1"><data key="d0">email:bob@example.com</data><data key="d1">1</data></node>
+    <node id="1234567892"/>
+    <edge source="n0" target="n1"><data key="d2">7</data></edge>
+    <edge source="n1" target="1234567892"/>
+  </graph>
+</graphml>`
+
+    graph, err := ParseGraphML(strings.NewReader(input), "calls.graphml", &ImportOptions{DefaultTelecom: 2})
+    if err != nil {
+        panic("ERROR: GraphML import failed: " + err.Error())
+    }
+
+    n0 := AgencyPair{"1234567890", 0, KindPhone}
+    n1 := AgencyPair{"bob@example.com", 1, KindEmail}
+    n2 := AgencyPair{"1234567892", 2, KindPhone}
+    if !graph.ContainsEdge(n0, n1) || !graph.ContainsEdge(n1, n2) {
+        panic("ERROR: GraphML import produced wrong edges")
+    }
+    if graph.Neighbors(n0)[0].Weight != 7 {
+        panic("ERROR: GraphML import produced wrong weight")
+    }
+
+    println("PASS: GraphML import test")
+}
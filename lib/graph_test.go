@@ -6,12 +6,12 @@ import (
 
 func TestTelecomGraph(t *testing.T) {
     nodeList := [6]AgencyPair {
-        AgencyPair{"1234567890", 0},
-        AgencyPair{"1234567891", 1},
-        AgencyPair{"1234567892", 2},
-        AgencyPair{"1234567893", 3},
-        AgencyPair{"1234567894", 4},
-        AgencyPair{"1234567895", 5},
+        AgencyPair{"1234567890", 0, KindPhone},
+        AgencyPair{"1234567891", 1, KindPhone},
+        AgencyPair{"1234567892", 2, KindPhone},
+        AgencyPair{"1234567893", 3, KindPhone},
+        AgencyPair{"1234567894", 4, KindPhone},
+        AgencyPair{"1234567895", 5, KindPhone},
     }
 
     myGraph := NewGraph(nodeList[:])
@@ -47,12 +47,12 @@ func TestTGFReader(t *testing.T) {
     graph, _ := ReadGraph("tgf_example.tgf")
 
     nodeList := [6]AgencyPair {
-        AgencyPair{"1234567890", 0},
-        AgencyPair{"1234567891", 1},
-        AgencyPair{"1234567892", 2},
-        AgencyPair{"1234567893", 3},
-        AgencyPair{"1234567894", 4},
-        AgencyPair{"1234567895", 5},
+        AgencyPair{"1234567890", 0, KindPhone},
+        AgencyPair{"1234567891", 1, KindPhone},
+        AgencyPair{"1234567892", 2, KindPhone},
+        AgencyPair{"1234567893", 3, KindPhone},
+        AgencyPair{"1234567894", 4, KindPhone},
+        AgencyPair{"1234567895", 5, KindPhone},
     }
 
     for _, val := range nodeList {
@@ -76,3 +76,42 @@ func TestTGFReader(t *testing.T) {
 
     println("PASS: TGF edge test")
 }
+
+func TestTGFIdentifiers(t *testing.T) {
+    graph, err := ReadGraph("tgf_identifiers.tgf")
+    if err != nil {
+        panic("ERROR: could not read graph: " + err.Error())
+    }
+
+    phone := AgencyPair{"1234567890", 0, KindPhone}
+    imsi := AgencyPair{"310150123456789", 0, KindIMSI}
+    email := AgencyPair{"alice@example.com", 1, KindEmail}
+    handle := AgencyPair{"signal/+15550100", 1, KindHandle}
+
+    for _, val := range []AgencyPair{phone, imsi, email, handle} {
+        if !graph.ContainsNode(val) {
+            panic("ERROR: graph doesn't contain node " + val.ID())
+        }
+        if graph.Telecom(val.ID()) != val.Telecom {
+            panic("ERROR: wrong telecom for " + val.ID())
+        }
+    }
+
+    if !graph.ContainsEdge(phone, imsi) ||
+       !graph.ContainsEdge(imsi, email) ||
+       !graph.ContainsEdge(handle, phone) {
+            panic("ERROR: Graph doesn't contain edge")
+    }
+
+    if kind, value := ParseIdentifier(imsi.ID()); kind != KindIMSI || value != imsi.Node {
+        panic("ERROR: identifier did not round-trip")
+    }
+    if kind, value := ParseIdentifier("+1 555 0100"); kind != KindPhone || value != "+1 555 0100" {
+        panic("ERROR: plain number not parsed as phone")
+    }
+    if KindAllowed([]IDKind{KindPhone, KindIMSI}, KindEmail) || !KindAllowed(nil, KindEmail) {
+        panic("ERROR: wrong kind filtering")
+    }
+
+    println("PASS: TGF identifier test")
+}
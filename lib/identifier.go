@@ -0,0 +1,79 @@
+package lib
+
+import (
+    "fmt"
+    "strings"
+)
+
+// IDKind is the type of subscriber identifier a graph node stands for
+type IDKind int
+
+const (
+    KindPhone IDKind = iota
+    KindIMSI
+    KindIMEI
+    KindEmail
+    KindHandle
+)
+
+var kindNames = [...]string{"phone", "imsi", "imei", "email", "handle"}
+
+func (k IDKind) String() string {
+    if k < 0 || int(k) >= len(kindNames) {
+        return fmt.Sprintf("kind(%d)", int(k))
+    }
+    return kindNames[k]
+}
+
+// ParseKind returns the kind with the given name
+func ParseKind(name string) (IDKind, error) {
+    for i, n := range kindNames {
+        if n == strings.ToLower(name) {
+            return IDKind(i), nil
+        }
+    }
+    return KindPhone, fmt.Errorf("unknown identifier kind %q", name)
+}
+
+// ParseIdentifier splits an identifier of the form "kind:value".  Identifiers
+// without a known kind prefix are phone numbers, so plain numbers keep working.
+func ParseIdentifier(id string) (IDKind, string) {
+    if i := strings.Index(id, ":"); i > 0 {
+        if kind, err := ParseKind(id[:i]); err == nil {
+            return kind, id[i+1:]
+        }
+    }
+    return KindPhone, id
+}
+
+// FormatIdentifier is the inverse of ParseIdentifier
+func FormatIdentifier(kind IDKind, value string) string {
+    if kind == KindPhone {
+        return value
+    }
+    return kind.String() + ":" + value
+}
+
+// NewPair builds the pair for an identifier in "kind:value" form
+func NewPair(id string, telecom int) AgencyPair {
+    kind, value := ParseIdentifier(id)
+    return AgencyPair{value, telecom, kind}
+}
+
+// ID returns the identifier of the pair in "kind:value" form
+func (p AgencyPair) ID() string {
+    return FormatIdentifier(p.Kind, p.Node)
+}
+
+// KindAllowed reports whether kind is in kinds; an empty list allows every kind
+func KindAllowed(kinds []IDKind, kind IDKind) bool {
+    if len(kinds) == 0 {
+        return true
+    }
+    for _, k := range kinds {
+        if k == kind {
+            return true
+        }
+    }
+    return false
+}
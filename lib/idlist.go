@@ -0,0 +1,31 @@
+package lib
+
+import (
+    "bufio"
+    "os"
+    "strings"
+)
+
+// ReadIDList reads a list of identifiers, one per line, such as a telecom's
+// list of hubs.  Blank lines and lines starting with '#' are skipped.
+func ReadIDList(path string) ([]string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var ids []string
+    scanner := bufio.NewScanner(file)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if strings.ContainsAny(line, " \t") {
+            return nil, &ParseError{path, lineNum, "expected one identifier per line"}
+        }
+        ids = append(ids, FormatIdentifier(ParseIdentifier(line)))
+    }
+    return ids, scanner.Err()
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func TestReadIDList(t *testing.T) {
+    file, err := ioutil.TempFile("", "ppcc-ids")
+    if err != nil {
+        panic("ERROR: " + err.Error())
+    }
+    defer os.Remove(file.Name())
+    file.WriteString("# call centers\n1234567896\n\n  imsi:310150123456789  \n")
+    file.Close()
+
+    ids, err := ReadIDList(file.Name())
+    if err != nil || len(ids) != 2 || ids[0] != "1234567896" || ids[1] != "imsi:310150123456789" {
+        panic("ERROR: wrong identifier list")
+    }
+
+    // Hubs are found by list or by degree, and are not chained through
+    var graphs []*TelecomGraph
+    for _, path := range []string{"../simulation/graph0.tgf", "../simulation/graph1.tgf", "../simulation/graph2.tgf"} {
+        graph, err := ReadGraph(path)
+        if err != nil {
+            panic("ERROR: could not read graph: " + err.Error())
+        }
+        graphs = append(graphs, graph)
+    }
+    if graphs[1].ExcludeHubs(ids) != 1 || !graphs[1].IsHub(AgencyPair{"1234567896", 1, KindPhone}) {
+        panic("ERROR: listed hub not found")
+    }
+    target := AgencyPair{"1234567890", 0, KindPhone}
+    if len(ReferenceChain(graphs, target, 4, nil)) != 7 {
+        panic("ERROR: reference chained through hub")
+    }
+    graphs[0].HubDegree = 4
+    if !graphs[0].IsHub(target) || len(ReferenceChain(graphs, target, 4, nil)) != 1 {
+        panic("ERROR: hub degree ignored")
+    }
+
+    file, _ = ioutil.TempFile("", "ppcc-ids")
+    defer os.Remove(file.Name())
+    file.WriteString("1234567896 1\n")
+    file.Close()
+    if _, err := ReadIDList(file.Name()); err == nil {
+        panic("ERROR: malformed identifier list accepted")
+    }
+
+    println("PASS: Identifier list test")
+}
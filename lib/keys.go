@@ -0,0 +1,437 @@
+package lib
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+// KeyFileIterations is the PBKDF2 iteration count of the key files written
+var KeyFileIterations = 100000
+
+// NodeKey is a generation of the keys of a node: an ElGamal key for the
+// messages encrypted for the node, and a Schnorr key for the messages it
+// signs.  It is valid from NotBefore until NotAfter (in Unix nanoseconds), or
+// forever if NotAfter is 0.
+type NodeKey struct {
+    Version     int
+    NotBefore   int64
+    NotAfter    int64
+    Private     abstract.Scalar
+    SignKey     abstract.Scalar
+}
+
+func validAt(notBefore, notAfter int64, t time.Time) bool {
+    n := t.UnixNano()
+    return n >= notBefore && (notAfter == 0 || n < notAfter)
+}
+
+// ValidAt tells whether the key is valid at t
+func (k *NodeKey) ValidAt(t time.Time) bool {
+    return validAt(k.NotBefore, k.NotAfter, t)
+}
+
+// PublicKey returns the public half of the key
+func (k *NodeKey) PublicKey(suite abstract.Suite) PublicKey {
+    return PublicKey{
+        Version:    k.Version,
+        NotBefore:  k.NotBefore,
+        NotAfter:   k.NotAfter,
+        Public:     suite.Point().Mul(nil, k.Private),
+        VerifyKey:  suite.Point().Mul(nil, k.SignKey),
+    }
+}
+
+// PublicKey is the public half of a NodeKey
+type PublicKey struct {
+    Version     int
+    NotBefore   int64
+    NotAfter    int64
+    Public      abstract.Point
+    VerifyKey   abstract.Point
+}
+
+// ValidAt tells whether the key is valid at t
+func (k *PublicKey) ValidAt(t time.Time) bool {
+    return validAt(k.NotBefore, k.NotAfter, t)
+}
+
+// Keyring holds the keys of a node, oldest first.  Rotating the keys starts
+// a new key while the previous ones stay valid for an overlap, so that
+// messages encrypted for them can still be read.
+type Keyring struct {
+    mu          sync.Mutex
+    suite       abstract.Suite
+    Node        string
+    keys        []*NodeKey
+}
+
+// NewKeyring returns a keyring holding a fresh key for the named node
+func NewKeyring(suite abstract.Suite, node string) *Keyring {
+    r := &Keyring{suite: suite, Node: node}
+    r.keys = append(r.keys, r.newKey(1, time.Now()))
+    return r
+}
+
+func (r *Keyring) newKey(version int, notBefore time.Time) *NodeKey {
+    return &NodeKey{
+        Version:    version,
+        NotBefore:  notBefore.UnixNano(),
+        Private:    r.suite.Scalar().Pick(random.Stream),
+        SignKey:    r.suite.Scalar().Pick(random.Stream),
+    }
+}
+
+// Current returns the newest key valid now, or nil if every key expired
+func (r *Keyring) Current() *NodeKey {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.current(time.Now())
+}
+
+func (r *Keyring) current(t time.Time) *NodeKey {
+    for i := len(r.keys) - 1; i >= 0; i-- {
+        if r.keys[i].ValidAt(t) {
+            return r.keys[i]
+        }
+    }
+    return nil
+}
+
+// Key returns the key of the given version if it is valid now
+func (r *Keyring) Key(version int) *NodeKey {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, k := range r.keys {
+        if k.Version == version && k.ValidAt(time.Now()) {
+            return k
+        }
+    }
+    return nil
+}
+
+// Rotate starts a new key.  The keys valid now stay valid for overlap, and
+// none after.
+func (r *Keyring) Rotate(overlap time.Duration) *NodeKey {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    end := now.Add(overlap).UnixNano()
+    version := 0
+    for _, k := range r.keys {
+        if k.NotAfter == 0 || k.NotAfter > end {
+            k.NotAfter = end
+        }
+        if k.Version > version {
+            version = k.Version
+        }
+    }
+    key := r.newKey(version + 1, now)
+    r.keys = append(r.keys, key)
+    return key
+}
+
+// Prune drops the keys that expired, and returns how many
+func (r *Keyring) Prune() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now().UnixNano()
+    var kept []*NodeKey
+    for _, k := range r.keys {
+        if k.NotAfter == 0 || k.NotAfter > now {
+            kept = append(kept, k)
+        }
+    }
+    pruned := len(r.keys) - len(kept)
+    r.keys = kept
+    return pruned
+}
+
+// Publish returns the public keys valid now, signed with each of them, so
+// that whoever trusts one of the keys can trust its successor
+func (r *Keyring) Publish() PublishedKeys {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    p := PublishedKeys{Node: r.Node, Suite: r.suite.String(), Time: now.UnixNano()}
+    var signKeys []abstract.Scalar
+    for _, k := range r.keys {
+        if k.ValidAt(now) {
+            p.Keys = append(p.Keys, k.PublicKey(r.suite))
+            signKeys = append(signKeys, k.SignKey)
+        }
+    }
+    for _, key := range signKeys {
+        p.Signatures = append(p.Signatures, SchnorrSign(r.suite, random.Stream, p.message(), key))
+    }
+    return p
+}
+
+// PublishIdentity returns the published keys of a node without a keyring: the
+// key of its server identity, as key version 0, and a signing key
+func PublishIdentity(suite abstract.Suite, node string, public abstract.Point, signKey abstract.Scalar) PublishedKeys {
+    p := PublishedKeys{Node: node, Suite: suite.String(), Time: time.Now().UnixNano()}
+    p.Keys = []PublicKey{{Public: public, VerifyKey: suite.Point().Mul(nil, signKey)}}
+    p.Signatures = [][]byte{SchnorrSign(suite, random.Stream, p.message(), signKey)}
+    return p
+}
+
+// PublishedKeys are the public keys of a node at some time
+type PublishedKeys struct {
+    Node        string
+    Suite       string
+    Time        int64
+    Keys        []PublicKey
+    Signatures  [][]byte
+}
+
+func (p *PublishedKeys) message() []byte {
+    msg := fmt.Sprintf("%q|%q|%d", p.Node, p.Suite, p.Time)
+    for _, k := range p.Keys {
+        msg += fmt.Sprintf("|%d|%d|%d|%v|%v", k.Version, k.NotBefore, k.NotAfter, k.Public, k.VerifyKey)
+    }
+    return []byte(msg)
+}
+
+// Current returns the newest key valid at t, or nil
+func (p *PublishedKeys) Current(t time.Time) *PublicKey {
+    for i := len(p.Keys) - 1; i >= 0; i-- {
+        if p.Keys[i].ValidAt(t) {
+            return &p.Keys[i]
+        }
+    }
+    return nil
+}
+
+// HasVerifyKey tells whether a signing key of the node is valid at t
+func (p *PublishedKeys) HasVerifyKey(verifyKey abstract.Point, t time.Time) bool {
+    for _, k := range p.Keys {
+        if k.ValidAt(t) && k.VerifyKey.Equal(verifyKey) {
+            return true
+        }
+    }
+    return false
+}
+
+// VerifyPublishedKeys checks that published keys are keys of the suite, signed
+// with every key they hold
+func VerifyPublishedKeys(suite abstract.Suite, p PublishedKeys) error {
+    if p.Suite != suite.String() {
+        return fmt.Errorf("published keys of suite %s instead of %s", p.Suite, suite.String())
+    }
+    if len(p.Keys) == 0 {
+        return errors.New("no published keys")
+    }
+    if len(p.Signatures) != len(p.Keys) {
+        return errors.New("published keys not signed by every key")
+    }
+    for i, k := range p.Keys {
+        if err := SchnorrVerify(suite, p.message(), k.VerifyKey, p.Signatures[i]); err != nil {
+            return fmt.Errorf("published key %d: %v", k.Version, err)
+        }
+    }
+    return nil
+}
+
+// keyFile is the content of a key file: the keys are encrypted with
+// AES-GCM under a key derived from a passphrase with PBKDF2-HMAC-SHA256
+type keyFile struct {
+    Node        string
+    Suite       string
+    Iterations  int
+    Salt        []byte
+    Nonce       []byte
+    Box         []byte
+}
+
+// storedKey is a NodeKey as stored in a key file
+type storedKey struct {
+    Version     int
+    NotBefore   int64
+    NotAfter    int64
+    Private     []byte
+    SignKey     []byte
+}
+
+// Save writes the keyring to a key file readable only by its owner
+func (r *Keyring) Save(path, passphrase string) error {
+    r.mu.Lock()
+    stored := make([]storedKey, len(r.keys))
+    for i, k := range r.keys {
+        private, err := k.Private.MarshalBinary()
+        if err != nil {
+            r.mu.Unlock()
+            return err
+        }
+        signKey, err := k.SignKey.MarshalBinary()
+        if err != nil {
+            r.mu.Unlock()
+            return err
+        }
+        stored[i] = storedKey{k.Version, k.NotBefore, k.NotAfter, private, signKey}
+    }
+    r.mu.Unlock()
+    plain, err := json.Marshal(stored)
+    if err != nil {
+        return err
+    }
+
+    f := keyFile{Node: r.Node, Suite: r.suite.String(), Iterations: KeyFileIterations, Salt: make([]byte, 16)}
+    if _, err := rand.Read(f.Salt); err != nil {
+        return err
+    }
+    aead, err := newGCM(pbkdf2(passphrase, f.Salt, f.Iterations, 32))
+    if err != nil {
+        return err
+    }
+    f.Nonce = make([]byte, aead.NonceSize())
+    if _, err := rand.Read(f.Nonce); err != nil {
+        return err
+    }
+    f.Box = aead.Seal(nil, f.Nonce, plain, []byte(f.Node))
+    buf, err := json.Marshal(f)
+    if err != nil {
+        return err
+    }
+
+    // Replace the file in one step, so that a crash leaves the old keys
+    tmp := path + ".tmp"
+    if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// LoadKeyring reads the keyring of the named node from a key file
+func LoadKeyring(suite abstract.Suite, path, node, passphrase string) (*Keyring, error) {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var f keyFile
+    if err := json.Unmarshal(buf, &f); err != nil {
+        return nil, fmt.Errorf("malformed key file %s: %v", path, err)
+    }
+    if f.Suite != suite.String() {
+        return nil, fmt.Errorf("key file %s holds keys of suite %s", path, f.Suite)
+    }
+    if f.Iterations <= 0 {
+        return nil, fmt.Errorf("malformed key file %s", path)
+    }
+    aead, err := newGCM(pbkdf2(passphrase, f.Salt, f.Iterations, 32))
+    if err != nil {
+        return nil, err
+    }
+    if len(f.Nonce) != aead.NonceSize() {
+        return nil, fmt.Errorf("malformed key file %s", path)
+    }
+    plain, err := aead.Open(nil, f.Nonce, f.Box, []byte(f.Node))
+    if err != nil {
+        return nil, fmt.Errorf("wrong passphrase for key file %s, or file corrupted", path)
+    }
+    if f.Node != node {
+        return nil, fmt.Errorf("key file %s holds the keys of %s instead of %s", path, f.Node, node)
+    }
+    var stored []storedKey
+    if err := json.Unmarshal(plain, &stored); err != nil {
+        return nil, fmt.Errorf("malformed keys in %s: %v", path, err)
+    }
+
+    r := &Keyring{suite: suite, Node: f.Node}
+    for _, s := range stored {
+        k := &NodeKey{
+            Version:    s.Version,
+            NotBefore:  s.NotBefore,
+            NotAfter:   s.NotAfter,
+            Private:    suite.Scalar(),
+            SignKey:    suite.Scalar(),
+        }
+        if err := k.Private.UnmarshalBinary(s.Private); err != nil {
+            return nil, err
+        }
+        if err := k.SignKey.UnmarshalBinary(s.SignKey); err != nil {
+            return nil, err
+        }
+        r.keys = append(r.keys, k)
+    }
+    return r, nil
+}
+
+// WritePublicKeys writes public keys to a file, one hex-encoded key per line
+func WritePublicKeys(path string, publics []abstract.Point) error {
+    var lines []string
+    for _, public := range publics {
+        buf, err := public.MarshalBinary()
+        if err != nil {
+            return err
+        }
+        lines = append(lines, hex.EncodeToString(buf))
+    }
+    return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n") + "\n"), 0644)
+}
+
+// ReadPublicKeys reads the public keys of a file written by WritePublicKeys
+func ReadPublicKeys(suite abstract.Suite, path string) ([]abstract.Point, error) {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var publics []abstract.Point
+    for i, line := range strings.Split(string(buf), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        key, err := hex.DecodeString(line)
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", path, i + 1, err)
+        }
+        public := suite.Point()
+        if err := public.UnmarshalBinary(key); err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", path, i + 1, err)
+        }
+        publics = append(publics, public)
+    }
+    if len(publics) == 0 {
+        return nil, fmt.Errorf("no public key in %s", path)
+    }
+    return publics, nil
+}
+
+// pbkdf2 derives a key from a passphrase as in RFC 8018, with HMAC-SHA256
+func pbkdf2(passphrase string, salt []byte, iterations, keyLen int) []byte {
+    prf := hmac.New(sha256.New, []byte(passphrase))
+    var key []byte
+    for block := uint32(1); len(key) < keyLen; block++ {
+        prf.Reset()
+        prf.Write(salt)
+        var counter [4]byte
+        binary.BigEndian.PutUint32(counter[:], block)
+        prf.Write(counter[:])
+        u := prf.Sum(nil)
+        t := append([]byte{}, u...)
+        for i := 1; i < iterations; i++ {
+            prf.Reset()
+            prf.Write(u)
+            u = prf.Sum(u[:0])
+            for j := range t {
+                t[j] ^= u[j]
+            }
+        }
+        key = append(key, t...)
+    }
+    return key[:keyLen]
+}
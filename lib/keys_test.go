@@ -0,0 +1,163 @@
+package lib
+
+import (
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/nist"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+func TestPBKDF2(t *testing.T) {
+    // Test vector of RFC 7914, section 11
+    key := pbkdf2("passwd", []byte("salt"), 1, 64)
+    expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+        "49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+    if hex.EncodeToString(key) != expected {
+        panic("ERROR: wrong PBKDF2 output")
+    }
+
+    println("PASS: PBKDF2 test")
+}
+
+func TestKeyring(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    ring := NewKeyring(suite, "telecom0")
+    first := ring.Current()
+    if first == nil || first.Version != 1 {
+        panic("ERROR: no first key")
+    }
+
+    // After a rotation both keys are valid until the overlap ends, and
+    // messages are read with the key they were encrypted for
+    second := ring.Rotate(time.Hour)
+    if ring.Current() != second || second.Version != 2 || first.NotAfter == 0 || second.NotAfter != 0 {
+        panic("ERROR: wrong keys after rotation")
+    }
+    sender := NewPPCC(suite, suite.Scalar().Pick(random.Stream),
+        []abstract.Point{suite.Point().Mul(nil, first.Private), suite.Point().Mul(nil, second.Private)})
+    sender.SetKeyVersions([]int{1, 2})
+    receiver, err := NewKeyedPPCC(suite, ring, []abstract.Point{suite.Point().Null()}, []int{0})
+    if err != nil {
+        panic("ERROR: could not create keyed PPCC: " + err.Error())
+    }
+    for idx := 0; idx < 2; idx++ {
+        enc, err := sender.EncryptTelecomMessage("1234567890", idx)
+        if err != nil {
+            panic("ERROR: could not encrypt: " + err.Error())
+        }
+        if msg, err := receiver.DecryptTelecomMessage(enc); err != nil || msg != "1234567890" {
+            panic("ERROR: message for rotated key not decrypted")
+        }
+    }
+
+    // A node with a keyring published its keys, so messages for its
+    // identity, as version 0, or for a version it does not hold are refused
+    for _, version := range []int{0, 3} {
+        enc, err := sender.EncryptTelecomMessage("1234567890", 1)
+        if err != nil {
+            panic("ERROR: could not encrypt: " + err.Error())
+        }
+        enc.KeyVersion = version
+        if _, err := receiver.DecryptTelecomMessage(enc); err == nil {
+            panic(fmt.Sprintf("ERROR: message for key version %d decrypted", version))
+        }
+        if _, err := receiver.ReencryptTelecomMessage(enc, 0); err == nil {
+            panic(fmt.Sprintf("ERROR: message for key version %d reencrypted", version))
+        }
+    }
+
+    // The published keys are signed with every valid key
+    published := ring.Publish()
+    if len(published.Keys) != 2 || published.Current(time.Now()).Version != 2 {
+        panic("ERROR: wrong published keys")
+    }
+    if VerifyPublishedKeys(suite, published) != nil {
+        panic("ERROR: published keys do not verify")
+    }
+    if !published.HasVerifyKey(receiver.VerifyKey, time.Now()) {
+        panic("ERROR: signing key not published")
+    }
+    published.Keys[0].NotAfter++
+    if VerifyPublishedKeys(suite, published) == nil {
+        panic("ERROR: altered published keys verified")
+    }
+
+    // A node without a keyring publishes its identity and a signing key
+    identity := suite.Scalar().Pick(random.Stream)
+    signer := NewPPCC(suite, identity, nil)
+    signer.SetSignKey(suite.Scalar().Pick(random.Stream))
+    published = PublishIdentity(suite, "agency", suite.Point().Mul(nil, identity), signer.signKey)
+    if VerifyPublishedKeys(suite, published) != nil || published.Current(time.Now()).Version != 0 ||
+        !published.HasVerifyKey(signer.VerifyKey, time.Now()) {
+        panic("ERROR: wrong published identity")
+    }
+
+    // Expired keys are pruned
+    ring.Rotate(0)
+    if ring.Prune() != 2 || ring.Key(1) != nil || ring.Current().Version != 3 {
+        panic("ERROR: expired keys kept")
+    }
+
+    println("PASS: Keyring test")
+}
+
+func TestKeyFile(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    dir, err := ioutil.TempDir("", "keys")
+    if err != nil {
+        panic("ERROR: " + err.Error())
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "telecom0.key")
+
+    ring := NewKeyring(suite, "telecom0")
+    ring.Rotate(time.Hour)
+    if err := ring.Save(path, "correct horse"); err != nil {
+        panic("ERROR: could not save keyring: " + err.Error())
+    }
+    info, err := os.Stat(path)
+    if err != nil || info.Mode().Perm() != 0600 {
+        panic("ERROR: key file readable by others")
+    }
+
+    loaded, err := LoadKeyring(suite, path, "telecom0", "correct horse")
+    if err != nil {
+        panic("ERROR: could not load keyring: " + err.Error())
+    }
+    if loaded.Node != "telecom0" || len(loaded.keys) != 2 {
+        panic("ERROR: wrong keys loaded")
+    }
+    for i, k := range loaded.keys {
+        if k.Version != ring.keys[i].Version || k.NotAfter != ring.keys[i].NotAfter ||
+            !k.Private.Equal(ring.keys[i].Private) || !k.SignKey.Equal(ring.keys[i].SignKey) {
+            panic("ERROR: loaded key differs")
+        }
+    }
+
+    if _, err := LoadKeyring(suite, path, "telecom0", "wrong horse"); err == nil {
+        panic("ERROR: keys loaded with wrong passphrase")
+    }
+    if _, err := LoadKeyring(suite, path, "telecom1", "correct horse"); err == nil {
+        panic("ERROR: keys of another node loaded")
+    }
+
+    // Public keys read back from their file
+    publics := []abstract.Point{ring.Current().PublicKey(suite).Public, ring.Current().PublicKey(suite).VerifyKey}
+    pubPath := filepath.Join(dir, "telecom0.pub")
+    if err := WritePublicKeys(pubPath, publics); err != nil {
+        panic("ERROR: could not write public keys: " + err.Error())
+    }
+    read, err := ReadPublicKeys(suite, pubPath)
+    if err != nil || len(read) != 2 || !read[0].Equal(publics[0]) || !read[1].Equal(publics[1]) {
+        panic("ERROR: wrong public keys read")
+    }
+
+    println("PASS: Key file test")
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+    "sync"
+)
+
+// Ledger records the contacts released under each warrant, so that the
+// contact budget of a warrant can be enforced across protocol runs, and so
+// that what a warrant released is known
+type Ledger struct {
+    mu          sync.Mutex
+    budgets     map[string]int
+    released    map[string]map[string]bool
+}
+
+func NewLedger() *Ledger {
+    return &Ledger{budgets: make(map[string]int), released: make(map[string]map[string]bool)}
+}
+
+// Released returns the number of contacts released under a warrant
+func (l *Ledger) Released(warrant string) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return len(l.released[warrant])
+}
+
+// IsReleased tells whether a contact was released under a warrant
+func (l *Ledger) IsReleased(warrant, id string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.released[warrant][id]
+}
+
+// Release asks to release contacts under a warrant allowing max contacts in
+// total, or any number if max is negative.  The smallest budget given for a
+// warrant holds for it, so that a budget cannot be raised.  Contacts
+// released before are granted again; the others are granted in order while
+// the budget lasts.  It records the contacts granted and returns how many of
+// ids, from the first, may be released.
+func (l *Ledger) Release(warrant string, ids []string, max int) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if budget, ok := l.budgets[warrant]; ok && (max < 0 || budget < max) {
+        max = budget
+    } else if max >= 0 {
+        l.budgets[warrant] = max
+    }
+    released := l.released[warrant]
+    if released == nil {
+        released = make(map[string]bool)
+        l.released[warrant] = released
+    }
+    for i, id := range ids {
+        if !released[id] && max >= 0 && len(released) >= max {
+            return i
+        }
+        released[id] = true
+    }
+    return len(ids)
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+    "testing"
+)
+
+func TestLedger(t *testing.T) {
+    l := NewLedger()
+
+    if l.Release("w1", []string{"a", "b", "c"}, 5) != 3 || l.Release("w1", []string{"d", "e", "f"}, 5) != 2 ||
+        l.Release("w1", []string{"g"}, 5) != 0 {
+        panic("ERROR: ledger exceeded its budget")
+    }
+    if l.Released("w1") != 5 || !l.IsReleased("w1", "e") || l.IsReleased("w1", "f") {
+        panic("ERROR: wrong released contacts")
+    }
+
+    // Contacts released before are granted again, and a budget cannot be
+    // raised, only lowered
+    if l.Release("w1", []string{"a", "b"}, 5) != 2 || l.Release("w1", []string{"h"}, -1) != 0 ||
+        l.Release("w1", []string{"h"}, 10) != 0 {
+        panic("ERROR: ledger budget raised")
+    }
+    if l.Release("w4", []string{"a", "b"}, 5) != 2 || l.Release("w4", []string{"c"}, 2) != 0 {
+        panic("ERROR: ledger budget not lowered")
+    }
+
+    // Warrants are counted separately, and a negative budget does not limit
+    if l.Release("w2", []string{"a", "b"}, 0) != 0 || l.Release("w3", []string{"a", "b"}, -1) != 2 ||
+        l.IsReleased("w2", "a") || !l.IsReleased("w3", "a") {
+        panic("ERROR: ledger mixed up warrants")
+    }
+
+    println("PASS: Ledger test")
+}
@@ -0,0 +1,223 @@
+package lib
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+// The Merkle trees of transparency logs follow RFC 6962: leaves and inner
+// nodes are hashed with distinct prefixes, and a tree of n leaves splits at
+// the largest power of two below n.
+
+func leafHash(data []byte) []byte {
+    h := sha256.New()
+    h.Write([]byte{0})
+    h.Write(data)
+    return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+    h := sha256.New()
+    h.Write([]byte{1})
+    h.Write(left)
+    h.Write(right)
+    return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n
+func split(n int) int {
+    k := 1
+    for k << 1 < n {
+        k <<= 1
+    }
+    return k
+}
+
+// merkleRoot returns the root of the tree over the given leaf hashes
+func merkleRoot(hashes [][]byte) []byte {
+    switch len(hashes) {
+    case 0:
+        h := sha256.Sum256(nil)
+        return h[:]
+    case 1:
+        return hashes[0]
+    }
+    k := split(len(hashes))
+    return nodeHash(merkleRoot(hashes[:k]), merkleRoot(hashes[k:]))
+}
+
+// merklePath returns the inclusion proof of leaf m among the leaf hashes
+func merklePath(m int, hashes [][]byte) [][]byte {
+    if len(hashes) <= 1 {
+        return nil
+    }
+    k := split(len(hashes))
+    if m < k {
+        return append(merklePath(m, hashes[:k]), merkleRoot(hashes[k:]))
+    }
+    return append(merklePath(m - k, hashes[k:]), merkleRoot(hashes[:k]))
+}
+
+// VerifyInclusion checks that leaf is the leaf at index of the tree of the
+// given size and root
+func VerifyInclusion(leaf []byte, index, size int, proof [][]byte, root []byte) error {
+    if index < 0 || index >= size {
+        return errors.New("leaf index out of range")
+    }
+
+    fn, sn := index, size - 1
+    r := leafHash(leaf)
+    for _, p := range proof {
+        if sn == 0 {
+            return errors.New("inclusion proof too long")
+        }
+        if fn & 1 == 1 || fn == sn {
+            r = nodeHash(p, r)
+            for fn & 1 == 0 && fn != 0 {
+                fn >>= 1
+                sn >>= 1
+            }
+        } else {
+            r = nodeHash(r, p)
+        }
+        fn >>= 1
+        sn >>= 1
+    }
+    if sn != 0 || !bytes.Equal(r, root) {
+        return errors.New("leaf not included in tree")
+    }
+    return nil
+}
+
+// WarrantEntry is the record of an issued warrant in a transparency log.
+// Hash commits to the whole warrant, its target included, while Scope states
+// in the clear what the warrant allows.  Signature is the issuer's signature
+// of Hash.
+type WarrantEntry struct {
+    Hash        []byte
+    Issuer      string
+    Scope       string
+    Time        int64
+    Signature   []byte
+}
+
+// Leaf is the encoding of the entry in the log
+func (e *WarrantEntry) Leaf() []byte {
+    return []byte(fmt.Sprintf("%x|%q|%q|%d|%x", e.Hash, e.Issuer, e.Scope, e.Time, e.Signature))
+}
+
+// SignedTreeHead is the root of a transparency log at some size, signed by
+// every node running the log
+type SignedTreeHead struct {
+    Size        int
+    Root        []byte
+    Time        int64
+    Signatures  [][]byte
+}
+
+func (h *SignedTreeHead) message() []byte {
+    return []byte(fmt.Sprintf("%d|%x|%d", h.Size, h.Root, h.Time))
+}
+
+// VerifyTreeHead checks that a tree head is signed by all the given keys
+func VerifyTreeHead(suite abstract.Suite, publics []abstract.Point, h SignedTreeHead) error {
+    if len(publics) == 0 || len(h.Signatures) != len(publics) {
+        return errors.New("tree head not signed by every log node")
+    }
+    for i, public := range publics {
+        if err := SchnorrVerify(suite, h.message(), public, h.Signatures[i]); err != nil {
+            return fmt.Errorf("tree head signature %d: %v", i, err)
+        }
+    }
+    return nil
+}
+
+// VerifyWarrantEntry checks that an entry is included in a transparency log
+// whose nodes have the given keys
+func VerifyWarrantEntry(suite abstract.Suite, publics []abstract.Point, entry WarrantEntry,
+    index int, proof [][]byte, h SignedTreeHead) error {
+
+    if err := VerifyTreeHead(suite, publics, h); err != nil {
+        return err
+    }
+    return VerifyInclusion(entry.Leaf(), index, h.Size, proof, h.Root)
+}
+
+// TransparencyLog is an append-only Merkle log of warrants, run by a set of
+// nodes which all sign its tree heads
+type TransparencyLog struct {
+    mu          sync.Mutex
+    suite       abstract.Suite
+    keys        []abstract.Scalar
+    Publics     []abstract.Point
+    entries     []WarrantEntry
+    hashes      [][]byte
+}
+
+// NewTransparencyLog returns an empty log run by nodes with the given keys
+func NewTransparencyLog(suite abstract.Suite, keys []abstract.Scalar) *TransparencyLog {
+    l := &TransparencyLog{suite: suite, keys: keys}
+    for _, key := range keys {
+        l.Publics = append(l.Publics, suite.Point().Mul(nil, key))
+    }
+    return l
+}
+
+// Append publishes an entry and returns its index
+func (l *TransparencyLog) Append(e WarrantEntry) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.entries = append(l.entries, e)
+    l.hashes = append(l.hashes, leafHash(e.Leaf()))
+    return len(l.entries) - 1
+}
+
+// Find returns the index of an entry
+func (l *TransparencyLog) Find(e WarrantEntry) (int, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    leaf := leafHash(e.Leaf())
+    for i, h := range l.hashes {
+        if bytes.Equal(h, leaf) {
+            return i, true
+        }
+    }
+    return 0, false
+}
+
+// TreeHead returns the current tree head, signed by every log node
+func (l *TransparencyLog) TreeHead() SignedTreeHead {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.treeHead()
+}
+
+func (l *TransparencyLog) treeHead() SignedTreeHead {
+    h := SignedTreeHead{
+        Size:   len(l.hashes),
+        Root:   merkleRoot(l.hashes),
+        Time:   time.Now().UnixNano(),
+    }
+    for _, key := range l.keys {
+        h.Signatures = append(h.Signatures, SchnorrSign(l.suite, random.Stream, h.message(), key))
+    }
+    return h
+}
+
+// Prove returns the inclusion proof of the entry at index in the current
+// tree, and the tree's head
+func (l *TransparencyLog) Prove(index int) ([][]byte, SignedTreeHead, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if index < 0 || index >= len(l.hashes) {
+        return nil, SignedTreeHead{}, errors.New("no such entry")
+    }
+    return merklePath(index, l.hashes), l.treeHead(), nil
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+    "fmt"
+    "testing"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/nist"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+func TestMerkleInclusion(t *testing.T) {
+    for size := 1; size <= 17; size++ {
+        var leaves, hashes [][]byte
+        for i := 0; i < size; i++ {
+            leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+            hashes = append(hashes, leafHash(leaves[i]))
+        }
+        root := merkleRoot(hashes)
+
+        for i := 0; i < size; i++ {
+            proof := merklePath(i, hashes)
+            if err := VerifyInclusion(leaves[i], i, size, proof, root); err != nil {
+                panic(fmt.Sprintf("ERROR: leaf %d of %d not included: %v", i, size, err))
+            }
+            if VerifyInclusion([]byte("other"), i, size, proof, root) == nil {
+                panic("ERROR: other leaf included")
+            }
+            if size > 1 && VerifyInclusion(leaves[i], (i + 1) % size, size, proof, root) == nil {
+                panic("ERROR: leaf included at another index")
+            }
+        }
+    }
+
+    println("PASS: Merkle inclusion test")
+}
+
+func TestTransparencyLog(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    keys := []abstract.Scalar{suite.Scalar().Pick(random.Stream), suite.Scalar().Pick(random.Stream)}
+    l := NewTransparencyLog(suite, keys)
+
+    var entries []WarrantEntry
+    for i := 0; i < 5; i++ {
+        e := WarrantEntry{Hash: []byte{byte(i)}, Issuer: "court", Scope: "depth 2", Time: int64(i)}
+        if l.Append(e) != i {
+            panic("ERROR: wrong entry index")
+        }
+        entries = append(entries, e)
+    }
+
+    for i, e := range entries {
+        index, ok := l.Find(e)
+        if !ok || index != i {
+            panic("ERROR: entry not found")
+        }
+        proof, head, err := l.Prove(index)
+        if err != nil || VerifyWarrantEntry(suite, l.Publics, e, index, proof, head) != nil {
+            panic("ERROR: logged entry does not verify")
+        }
+
+        // An entry with another scope is not in the log
+        other := e
+        other.Scope = "depth 3"
+        if VerifyWarrantEntry(suite, l.Publics, other, index, proof, head) == nil {
+            panic("ERROR: unlogged entry verified")
+        }
+
+        // Every log node has to sign the tree head
+        if VerifyWarrantEntry(suite, l.Publics[:1], e, index, proof, head) == nil {
+            panic("ERROR: tree head verified with missing signer")
+        }
+        head.Size++
+        if VerifyTreeHead(suite, l.Publics, head) == nil {
+            panic("ERROR: altered tree head verified")
+        }
+    }
+
+    if _, ok := l.Find(WarrantEntry{Hash: []byte{9}}); ok {
+        panic("ERROR: unlogged entry found")
+    }
+
+    println("PASS: Transparency log test")
+}
@@ -1,18 +1,40 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/random"
 	//"math/rand"
 	//"sync"
 )
 
+// CryptoStats counts the cryptographic operations of a PPCC and the time
+// spent in them
+type CryptoStats struct {
+    Encryptions     int
+    EncryptTime     time.Duration
+    Decryptions     int
+    DecryptTime     time.Duration
+    Signatures      int
+    SignTime        time.Duration
+    Verifications   int
+    VerifyTime      time.Duration
+}
+
 type PPCC struct {
     suite           abstract.Suite
     publics         []abstract.Point
     private         abstract.Scalar
     signKey         abstract.Scalar
     VerifyKey       abstract.Point
+    Stats           CryptoStats
+
+    // Keys of a PPCC created with NewKeyedPPCC
+    ring            *Keyring
+    versions        []int
 }
 
 func NewPPCC(suite abstract.Suite, private abstract.Scalar, publics []abstract.Point) *PPCC {
@@ -25,28 +47,122 @@ func NewPPCC(suite abstract.Suite, private abstract.Scalar, publics []abstract.P
     return ppcc;
 }
 
-func (c *PPCC) EncryptTelecomMessage(message string, idx int) (
-    K abstract.Point, C abstract.Point, remainder []byte) {
+// NewKeyedPPCC is like NewPPCC with the keys of a keyring: messages are
+// decrypted with the key version they were encrypted for, and signed with the
+// current signing key.  Messages for a version the keyring does not hold,
+// such as version 0, which is for nodes without a keyring, are refused.
+// versions holds the key version of every public key, 0 for nodes without a
+// keyring.
+func NewKeyedPPCC(suite abstract.Suite, ring *Keyring, publics []abstract.Point, versions []int) (*PPCC, error) {
+    key := ring.Current()
+    if key == nil {
+        return nil, errors.New("no valid key in keyring")
+    }
+    if len(versions) != len(publics) {
+        return nil, errors.New("a key version is needed for every public key")
+    }
+    return &PPCC{
+        suite:      suite,
+        publics:    publics,
+        private:    key.Private,
+        signKey:    key.SignKey,
+        VerifyKey:  suite.Point().Mul(nil, key.SignKey),
+        ring:       ring,
+        versions:   versions,
+    }, nil
+}
+
+// SetKeyVersions sets the key version of every public key, for recipients
+// with a keyring
+func (c *PPCC) SetKeyVersions(versions []int) {
+    c.versions = versions
+}
 
-    return ElGamalEncrypt(c.suite, c.publics[idx], []byte(message))
+func (c *PPCC) EncryptTelecomMessage(message string, idx int) (Ciphertext, error) {
+    defer c.Stats.since(&c.Stats.Encryptions, &c.Stats.EncryptTime, time.Now())
+    cipher, err := ElGamalEncryptMessage(c.suite, c.publics[idx], []byte(message))
+    if err == nil && c.versions != nil {
+        cipher.KeyVersion = c.versions[idx]
+    }
+    return cipher, err
 }
 
-func (c *PPCC) DecryptTelecomMessage(K, C abstract.Point) (message string, err error){
-    bytes, e := ElGamalDecrypt(c.suite, c.private, K, C)
+func (c *PPCC) DecryptTelecomMessage(cipher Ciphertext) (message string, err error){
+    defer c.Stats.since(&c.Stats.Decryptions, &c.Stats.DecryptTime, time.Now())
+    private, err := c.privateKey(cipher.KeyVersion)
+    if err != nil {
+        return "", err
+    }
+    bytes, e := ElGamalDecryptMessage(c.suite, private, cipher)
     message = string(bytes)
     err = e
     return
 }
 
+// ReencryptTelecomMessage decrypts a message to its points and encrypts them
+// for the node at idx, without decoding them, so that the result depends on
+// the ciphertext alone and not on whether it holds a valid message.  A
+// ciphertext for a key version not held is refused, like by
+// DecryptTelecomMessage.
+func (c *PPCC) ReencryptTelecomMessage(cipher Ciphertext, idx int) (Ciphertext, error) {
+    defer c.Stats.since(&c.Stats.Decryptions, &c.Stats.DecryptTime, time.Now())
+    private, err := c.privateKey(cipher.KeyVersion)
+    if err != nil {
+        return Ciphertext{}, err
+    }
+
+    var out Ciphertext
+    for i := 0; i < len(cipher.K) && i < len(cipher.C); i++ {
+        if cipher.K[i] == nil || cipher.C[i] == nil {
+            continue
+        }
+        S := c.suite.Point().Mul(cipher.K[i], private)
+        M := c.suite.Point().Sub(cipher.C[i], S)
+        K, C, _ := PartialElGamalEncrypt(c.suite, c.publics[idx], M)
+        out.K = append(out.K, K)
+        out.C = append(out.C, C)
+    }
+    if c.versions != nil {
+        out.KeyVersion = c.versions[idx]
+    }
+    return out, nil
+}
+
+// privateKey returns the key decrypting messages for the given key version
+func (c *PPCC) privateKey(version int) (abstract.Scalar, error) {
+    if c.ring == nil {
+        return c.private, nil
+    }
+    key := c.ring.Key(version)
+    if key == nil {
+        return nil, fmt.Errorf("no valid key of version %d", version)
+    }
+    return key.Private, nil
+}
+
 func (c *PPCC) createSigKeys() {
     c.signKey = c.suite.Scalar().Pick(random.Stream)
     c.VerifyKey = c.suite.Point().Mul(nil, c.signKey)
 }
 
+// SetSignKey makes the PPCC sign with the given key
+func (c *PPCC) SetSignKey(key abstract.Scalar) {
+    c.signKey = key
+    c.VerifyKey = c.suite.Point().Mul(nil, key)
+}
+
 func (c *PPCC) SignMessage (message string) []byte {
+    defer c.Stats.since(&c.Stats.Signatures, &c.Stats.SignTime, time.Now())
     return SchnorrSign(c.suite, random.Stream, []byte(message), c.signKey)
 }
 
 func (c *PPCC) VerifyMessage (message string, pubKey abstract.Point, sigBuffer []byte) error {
+    defer c.Stats.since(&c.Stats.Verifications, &c.Stats.VerifyTime, time.Now())
     return SchnorrVerify(c.suite, []byte(message), pubKey, sigBuffer)
 }
+
+// since counts one operation that started at start
+func (s *CryptoStats) since(count *int, total *time.Duration, start time.Time) {
+    *count++
+    *total += time.Since(start)
+}
@@ -36,14 +36,30 @@ func TestCU(t *testing.T) {
 	c2 = NewPPCC(suite, private3, publics)
 
     message0 := "Test msg"
-    K0, C0, _ := c0.EncryptTelecomMessage(message0, 1)
-    decoded0, err := c1.DecryptTelecomMessage(K0, C0)
+    enc0, err := c0.EncryptTelecomMessage(message0, 1)
+    if err != nil {
+        panic("ERROR: Telecom Encryption failed: " + err.Error())
+    }
+    decoded0, err := c1.DecryptTelecomMessage(enc0)
     if err != nil || message0 != decoded0 {
         panic("ERROR: Telecom Decryption failed")
     }
 
     println("PASS: Telecom Decryption")
 
+    // Identifiers longer than one point's capacity must round-trip intact
+    message1 := "+44 20 7946 0958;imsi=234150999999999;imei=490154203237518"
+    enc1, err := c0.EncryptTelecomMessage(message1, 2)
+    if err != nil {
+        panic("ERROR: Telecom Encryption failed: " + err.Error())
+    }
+    decoded1, err := c2.DecryptTelecomMessage(enc1)
+    if err != nil || message1 != decoded1 {
+        panic("ERROR: Long Telecom Decryption failed")
+    }
+
+    println("PASS: Long Telecom Decryption")
+
     sig0 := c1.SignMessage(decoded0)
     pubKey1 := c1.VerifyKey
 
@@ -52,5 +68,48 @@ func TestCU(t *testing.T) {
     }
 
     println("PASS: Telecom Signature")
+
+    if c0.Stats.Encryptions != 2 || c1.Stats.Decryptions != 1 || c1.Stats.Signatures != 1 ||
+        c2.Stats.Verifications != 1 || c2.Stats.Decryptions != 1 {
+        panic("ERROR: Wrong crypto operation counts")
+    }
+
+    println("PASS: Telecom Stats")
 }
 
+
+func TestReencrypt(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    a := suite.Scalar().Pick(random.Stream)
+    b := suite.Scalar().Pick(random.Stream)
+    publics := []abstract.Point{suite.Point().Mul(nil, a), suite.Point().Mul(nil, b)}
+    agency := NewPPCC(suite, a, publics)
+    telecom := NewPPCC(suite, b, publics)
+
+    // A valid message is echoed to the agency unchanged
+    enc, err := agency.EncryptTelecomMessage("1234567890", 1)
+    if err != nil {
+        panic("ERROR: Telecom Encryption failed: " + err.Error())
+    }
+    echo, err := telecom.ReencryptTelecomMessage(enc, 0)
+    if err != nil {
+        panic("ERROR: Reencryption failed: " + err.Error())
+    }
+    if msg, err := agency.DecryptTelecomMessage(echo); err != nil || msg != "1234567890" {
+        panic("ERROR: Reencrypted message not recovered")
+    }
+
+    // A corrupted message is echoed as the point it decrypts to
+    enc.C[0] = suite.Point().Add(enc.C[0], suite.Point().Base())
+    echo, _ = telecom.ReencryptTelecomMessage(enc, 0)
+    M, _ := PartialElGamalDecrypt(suite, b, enc.K[0], enc.C[0])
+    echoed, _ := PartialElGamalDecrypt(suite, a, echo.K[0], echo.C[0])
+    if len(echo.K) != 1 || !echoed.Equal(M) {
+        panic("ERROR: Corrupted message not echoed")
+    }
+    if echo, _ = telecom.ReencryptTelecomMessage(Ciphertext{}, 0); len(echo.K) != 0 {
+        panic("ERROR: Empty message not echoed empty")
+    }
+
+    println("PASS: Telecom Reencryption")
+}
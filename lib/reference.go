@@ -0,0 +1,87 @@
+package lib
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// ReferenceChain runs the contact chaining of a warrant in the clear, as a
+// reference for the output of the protocol.  Like the telecoms, it takes the
+// contacts of a node from the graph of the node's own carrier, does not
+// chain through hubs and only follows contacts whose kind is allowed.
+// Protected nodes are left out, both by the carrier of the node and by the
+// carrier revealing it, and so is a target its carrier does not hold.  The
+// result holds the identifiers of the target and of every node within depth
+// hops of it.
+func ReferenceChain(graphs []*TelecomGraph, target AgencyPair, depth int, kinds []IDKind) map[string]bool {
+    output := make(map[string]bool)
+    if protected(graphs, target.Telecom, target) || !known(graphs, target) {
+        return output
+    }
+    output[target.ID()] = true
+    frontier := []AgencyPair{target}
+
+    for hop := 0; hop < depth && len(frontier) > 0; hop++ {
+        var next []AgencyPair
+        for _, node := range frontier {
+            if node.Telecom < 0 || node.Telecom >= len(graphs) || graphs[node.Telecom].IsHub(node) {
+                continue
+            }
+            for _, edge := range graphs[node.Telecom].Neighbors(node) {
+                pair := edge.Pair
+                if !KindAllowed(kinds, pair.Kind) || output[pair.ID()] ||
+                    graphs[node.Telecom].IsProtected(pair) || protected(graphs, pair.Telecom, pair) {
+                    continue
+                }
+                output[pair.ID()] = true
+                next = append(next, pair)
+            }
+        }
+        frontier = next
+    }
+
+    return output
+}
+
+// protected tells whether the graph of a telecom protects a node
+func protected(graphs []*TelecomGraph, telecom int, node AgencyPair) bool {
+    return telecom >= 0 && telecom < len(graphs) && graphs[telecom].IsProtected(node)
+}
+
+// known tells whether the carrier of a node holds it
+func known(graphs []*TelecomGraph, node AgencyPair) bool {
+    return node.Telecom >= 0 && node.Telecom < len(graphs) && graphs[node.Telecom].ContainsNode(node)
+}
+
+// maxReportedDiff bounds the identifiers listed by CheckOutput
+var maxReportedDiff = 10
+
+// CheckOutput compares the output of a protocol run with the reference
+// output, returning an error listing missing and unexpected identifiers
+func CheckOutput(expected, actual map[string]bool) error {
+    var missing, unexpected []string
+    for id := range expected {
+        if !actual[id] {
+            missing = append(missing, id)
+        }
+    }
+    for id, ok := range actual {
+        if ok && !expected[id] {
+            unexpected = append(unexpected, id)
+        }
+    }
+    if len(missing) == 0 && len(unexpected) == 0 {
+        return nil
+    }
+
+    list := func(ids []string) string {
+        sort.Strings(ids)
+        if len(ids) > maxReportedDiff {
+            return strings.Join(ids[:maxReportedDiff], " ") + fmt.Sprintf(" ... (%d more)", len(ids) - maxReportedDiff)
+        }
+        return strings.Join(ids, " ")
+    }
+    return fmt.Errorf("output differs from reference: %d missing [%s], %d unexpected [%s]",
+        len(missing), list(missing), len(unexpected), list(unexpected))
+}
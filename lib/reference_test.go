@@ -0,0 +1,79 @@
+package lib
+
+import (
+    "testing"
+)
+
+func TestReferenceChain(t *testing.T) {
+    var graphs []*TelecomGraph
+    for _, file := range []string{"../simulation/graph0.tgf", "../simulation/graph1.tgf", "../simulation/graph2.tgf"} {
+        graph, err := ReadGraph(file)
+        if err != nil {
+            panic("ERROR: could not read graph: " + err.Error())
+        }
+        graphs = append(graphs, graph)
+    }
+
+    target := AgencyPair{"1234567890", 0, KindPhone}
+    expected := map[int][]string{
+        0: {"1234567890"},
+        1: {"1234567890", "1234567891", "1234567892", "1234567893", "1234567894", "1234567895"},
+        2: {"1234567890", "1234567891", "1234567892", "1234567893", "1234567894", "1234567895",
+            "1234567896"},
+        4: {"1234567890", "1234567891", "1234567892", "1234567893", "1234567894", "1234567895",
+            "1234567896", "1234567897", "1234567898", "1234567899"},
+    }
+
+    for depth, ids := range expected {
+        want := make(map[string]bool)
+        for _, id := range ids {
+            want[id] = true
+        }
+        if err := CheckOutput(want, ReferenceChain(graphs, target, depth, nil)); err != nil {
+            panic("ERROR: wrong reference output: " + err.Error())
+        }
+    }
+
+    // Chaining restricted to other kinds only reveals the target
+    if err := CheckOutput(map[string]bool{"1234567890": true},
+        ReferenceChain(graphs, target, 4, []IDKind{KindIMSI})); err != nil {
+        panic("ERROR: kind filter ignored: " + err.Error())
+    }
+
+    err := CheckOutput(map[string]bool{"a": true, "b": true}, map[string]bool{"b": true, "c": true})
+    if err == nil || err.Error() != "output differs from reference: 1 missing [a], 1 unexpected [c]" {
+        panic("ERROR: wrong output check")
+    }
+
+    println("PASS: Reference chain test")
+}
+
+func TestProtectedReference(t *testing.T) {
+    var graphs []*TelecomGraph
+    for _, path := range []string{"../simulation/graph0.tgf", "../simulation/graph1.tgf", "../simulation/graph2.tgf"} {
+        graph, err := ReadGraph(path)
+        if err != nil {
+            panic("ERROR: could not read graph: " + err.Error())
+        }
+        graphs = append(graphs, graph)
+    }
+
+    // Protected by its own telecom and by the revealing telecom
+    if graphs[1].Protect([]string{"1234567892", "5550000000"}) != 1 || graphs[0].Protect([]string{"1234567893"}) != 1 {
+        panic("ERROR: wrong number of protected nodes found")
+    }
+    output := ReferenceChain(graphs, AgencyPair{"1234567890", 0, KindPhone}, 4, nil)
+    if len(output) != 8 || output["1234567892"] || output["1234567893"] {
+        panic("ERROR: reference disclosed protected nodes")
+    }
+
+    graphs[2].Protect([]string{"1234567899"})
+    if len(ReferenceChain(graphs, AgencyPair{"1234567899", 2, KindPhone}, 2, nil)) != 0 {
+        panic("ERROR: reference disclosed protected target")
+    }
+    if len(ReferenceChain(graphs, AgencyPair{"5550000000", 2, KindPhone}, 2, nil)) != 0 {
+        panic("ERROR: reference disclosed unknown target")
+    }
+
+    println("PASS: Protected reference test")
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "errors"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// sealKeySize is the size of the AES keys of sealed messages
+const sealKeySize = 16
+
+// Sealed is a message of any size encrypted for a public key: the message is
+// encrypted with AES-GCM under a fresh key, itself ElGamal-encrypted
+type Sealed struct {
+    Key     Ciphertext
+    Nonce   []byte
+    Box     []byte
+}
+
+// Seal encrypts a message for the holder of the private key of pubkey
+func Seal(suite abstract.Suite, pubkey abstract.Point, message []byte) (Sealed, error) {
+    key := make([]byte, sealKeySize)
+    if _, err := rand.Read(key); err != nil {
+        return Sealed{}, err
+    }
+    encKey, err := ElGamalEncryptMessage(suite, pubkey, key)
+    if err != nil {
+        return Sealed{}, err
+    }
+
+    aead, err := newGCM(key)
+    if err != nil {
+        return Sealed{}, err
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return Sealed{}, err
+    }
+    return Sealed{
+        Key:    encKey,
+        Nonce:  nonce,
+        Box:    aead.Seal(nil, nonce, message, nil),
+    }, nil
+}
+
+// Open decrypts a sealed message
+func Open(suite abstract.Suite, prikey abstract.Scalar, s Sealed) ([]byte, error) {
+    key, err := ElGamalDecryptMessage(suite, prikey, s.Key)
+    if err != nil {
+        return nil, err
+    }
+    if len(key) != sealKeySize {
+        return nil, errors.New("malformed sealed key")
+    }
+
+    aead, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+    if len(s.Nonce) != aead.NonceSize() {
+        return nil, errors.New("malformed nonce")
+    }
+    return aead.Open(nil, s.Nonce, s.Box, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
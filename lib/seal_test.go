@@ -0,0 +1,36 @@
+package lib
+
+import (
+    "bytes"
+    "testing"
+
+    "gopkg.in/dedis/crypto.v0/nist"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+func TestSeal(t *testing.T) {
+    suite := nist.NewAES128SHA256P256()
+    a := suite.Scalar().Pick(random.Stream)
+    A := suite.Point().Mul(nil, a)
+
+    message := bytes.Repeat([]byte("transcript of a reply "), 500)
+    sealed, err := Seal(suite, A, message)
+    if err != nil {
+        panic("ERROR: could not seal: " + err.Error())
+    }
+    opened, err := Open(suite, a, sealed)
+    if err != nil || !bytes.Equal(opened, message) {
+        panic("ERROR: sealed message not recovered")
+    }
+
+    // Another key or a modified box do not open
+    if _, err := Open(suite, suite.Scalar().Pick(random.Stream), sealed); err == nil {
+        panic("ERROR: sealed message opened with another key")
+    }
+    sealed.Box[0] ^= 1
+    if _, err := Open(suite, a, sealed); err == nil {
+        panic("ERROR: modified sealed message opened")
+    }
+
+    println("PASS: Seal test")
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/ed25519"
+    "gopkg.in/dedis/crypto.v0/nist"
+)
+
+// suites holds the cipher suites that can be selected by name.  A suite must
+// embed data in points, for ElGamal encryption of identifiers.  Its name is
+// what the suite's String method returns, so that the suite of a node can be
+// recorded in messages and checked by the receiver.
+var suites = struct {
+    sync.Mutex
+    m   map[string]func() abstract.Suite
+}{m: map[string]func() abstract.Suite{
+    "P256":     func() abstract.Suite { return nist.NewAES128SHA256P256() },
+    "Ed25519":  func() abstract.Suite { return ed25519.NewAES128SHA256Ed25519(false) },
+}}
+
+// RegisterSuite makes a suite selectable under its name
+func RegisterSuite(newSuite func() abstract.Suite) {
+    name := newSuite().String()
+    suites.Lock()
+    suites.m[name] = newSuite
+    suites.Unlock()
+}
+
+// SuiteByName returns the suite of the given name
+func SuiteByName(name string) (abstract.Suite, error) {
+    suites.Lock()
+    newSuite, ok := suites.m[name]
+    suites.Unlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown suite %q, expected one of %v", name, SuiteNames())
+    }
+    return newSuite(), nil
+}
+
+// SuiteNames returns the names of the selectable suites, sorted
+func SuiteNames() []string {
+    suites.Lock()
+    defer suites.Unlock()
+    var names []string
+    for name := range suites.m {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
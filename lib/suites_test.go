@@ -0,0 +1,70 @@
+package lib
+
+import (
+    "bytes"
+    "testing"
+
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+)
+
+// TestSuites runs the ElGamal, Schnorr and sealing code on every suite
+func TestSuites(t *testing.T) {
+    if len(SuiteNames()) < 2 {
+        panic("ERROR: missing suites")
+    }
+    if _, err := SuiteByName("P1024"); err == nil {
+        panic("ERROR: unknown suite selected")
+    }
+
+    for _, name := range SuiteNames() {
+        suite, err := SuiteByName(name)
+        if err != nil || suite.String() != name {
+            panic("ERROR: could not select suite " + name)
+        }
+        a := suite.Scalar().Pick(random.Stream)
+        A := suite.Point().Mul(nil, a)
+        b := suite.Scalar().Pick(random.Stream)
+        B := suite.Point().Mul(nil, b)
+
+        // Identifiers longer than a point hold are split across points
+        message := []byte("email:someone.with.a.long.address@example.org")
+        enc, err := ElGamalEncryptMessage(suite, A, message)
+        if err != nil {
+            panic("ERROR: " + name + ": could not encrypt: " + err.Error())
+        }
+        dec, err := ElGamalDecryptMessage(suite, a, enc)
+        if err != nil || !bytes.Equal(dec, message) {
+            panic("ERROR: " + name + ": message not recovered")
+        }
+
+        sig := SchnorrSign(suite, random.Stream, message, a)
+        if SchnorrVerify(suite, message, A, sig) != nil || SchnorrVerify(suite, message, B, sig) == nil {
+            panic("ERROR: " + name + ": wrong signature check")
+        }
+
+        sealed, err := Seal(suite, B, message)
+        if err != nil {
+            panic("ERROR: " + name + ": could not seal: " + err.Error())
+        }
+        if opened, err := Open(suite, b, sealed); err != nil || !bytes.Equal(opened, message) {
+            panic("ERROR: " + name + ": sealed message not recovered")
+        }
+
+        c0 := NewPPCC(suite, a, []abstract.Point{A, B})
+        c1 := NewPPCC(suite, b, []abstract.Point{A, B})
+        enc, err = c0.EncryptTelecomMessage("1234567890", 1)
+        if err != nil {
+            panic("ERROR: " + name + ": could not encrypt: " + err.Error())
+        }
+        if msg, err := c1.DecryptTelecomMessage(enc); err != nil || msg != "1234567890" {
+            panic("ERROR: " + name + ": telecom message not recovered")
+        }
+        sig = c0.SignMessage("query")
+        if c1.VerifyMessage("query", c0.VerifyKey, sig) != nil {
+            panic("ERROR: " + name + ": query signature not verified")
+        }
+    }
+
+    println("PASS: Suites test")
+}
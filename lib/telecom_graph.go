@@ -1,16 +1,10 @@
 package lib
 
-import (
-    "os"
-    "bufio"
-    "strings"
-    "strconv"
-    "fmt"
-)
-
+// AgencyPair is a subscriber identifier together with the telecom serving it
 type AgencyPair struct {
     Node        string
     Telecom     int
+    Kind        IDKind
 }
 
 type Edge struct {
@@ -18,12 +12,19 @@ type Edge struct {
     Weight  int
 }
 
+// TelecomGraph is the call graph held by a telecom.  Hubs such as call
+// centers and voicemail are not chained through: they are the nodes of the
+// Hubs list, and, if HubDegree is set, the nodes with more neighbors.
+// Protected nodes, such as attorneys and journalists, are never disclosed.
 type TelecomGraph struct {
     NumNodes    int
     Nodes       map[AgencyPair]bool
     telecoms    map[string]int
     Visited     map[AgencyPair]bool
     Graph       map[AgencyPair][]Edge
+    Hubs        map[AgencyPair]bool
+    HubDegree   int
+    Protected   map[AgencyPair]bool
 }
 
 func NewGraph(nodeList []AgencyPair) *TelecomGraph {
@@ -31,7 +32,7 @@ func NewGraph(nodeList []AgencyPair) *TelecomGraph {
     tcoms := make(map[string]int)
     for _, item := range nodeList {
         contains[item] = true
-        tcoms[item.Node] = item.Telecom
+        tcoms[item.ID()] = item.Telecom
     }
 
     return &TelecomGraph {
@@ -40,11 +41,24 @@ func NewGraph(nodeList []AgencyPair) *TelecomGraph {
         telecoms:   tcoms,
         Visited:    make(map[AgencyPair]bool),
         Graph:      make(map[AgencyPair][]Edge),
+        Hubs:       make(map[AgencyPair]bool),
+        Protected:  make(map[AgencyPair]bool),
     }
 }
 
-func (g *TelecomGraph) Telecom (phone string) int {
-    return g.telecoms[phone]
+// Telecom returns the telecom of the node with the given identifier
+func (g *TelecomGraph) Telecom (id string) int {
+    kind, value := ParseIdentifier(id)
+    return g.telecoms[FormatIdentifier(kind, value)]
+}
+
+// TelecomMap returns the telecom of every node, keyed by identifier
+func (g *TelecomGraph) TelecomMap() map[string]int {
+    tcoms := make(map[string]int, len(g.telecoms))
+    for id, telecom := range g.telecoms {
+        tcoms[id] = telecom
+    }
+    return tcoms
 }
 
 func (g *TelecomGraph) ContainsNode(node AgencyPair) bool {
@@ -59,6 +73,53 @@ func (g *TelecomGraph) MarkVisited (node AgencyPair) {
     g.Visited[node] = true;
 }
 
+// ResetVisited forgets every visited node, so the graph can serve another run
+func (g *TelecomGraph) ResetVisited() {
+    g.Visited = make(map[AgencyPair]bool)
+}
+
+// IsHub tells whether a node is a hub
+func (g *TelecomGraph) IsHub(node AgencyPair) bool {
+    if g.Hubs[node] {
+        return true
+    }
+    return g.HubDegree > 0 && len(g.Graph[node]) > g.HubDegree
+}
+
+// ExcludeHubs adds the nodes with the given identifiers to the hub list, and
+// returns the number of them in the graph
+func (g *TelecomGraph) ExcludeHubs(ids []string) int {
+    found := 0
+    for _, id := range ids {
+        node := NewPair(id, g.Telecom(id))
+        if g.ContainsNode(node) {
+            g.Hubs[node] = true
+            found++
+        }
+    }
+    return found
+}
+
+// IsProtected tells whether a node must never be disclosed
+func (g *TelecomGraph) IsProtected(node AgencyPair) bool {
+    return g.Protected[node]
+}
+
+// Protect adds the nodes with the given identifiers to the protected list,
+// and returns the number of them in the graph.  Like a telecom's own list,
+// it may name subscribers of other telecoms.
+func (g *TelecomGraph) Protect(ids []string) int {
+    found := 0
+    for _, id := range ids {
+        node := NewPair(id, g.Telecom(id))
+        if g.ContainsNode(node) {
+            g.Protected[node] = true
+            found++
+        }
+    }
+    return found
+}
+
 func (g *TelecomGraph) ContainsEdge(node1 AgencyPair, node2 AgencyPair) bool {
     for _, neighbor := range g.Graph[node1] {
         if neighbor.Pair == node2 {
@@ -88,46 +149,5 @@ func (g *TelecomGraph) AddNode(node AgencyPair) {
 
     g.NumNodes++
     g.Nodes[node] = true
-}
-
-func ReadGraph (path string) (*TelecomGraph, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		fmt.Printf("%v\n", err)
-		return nil, err
-	}
-	defer file.Close()
-
-    var list []AgencyPair
-    scanner := bufio.NewScanner(file)
-
-    // First half of the TGF format:  Node definitions
-    for scanner.Scan() {
-
-        // Check for seperator
-        if scanner.Text() == "#" {
-            break
-        }
-
-        // Otherwise split into its components and form a pair
-        data := strings.Fields(scanner.Text())
-        phone := data[0]
-        telecom, _ := strconv.Atoi(data[1])
-        list = append(list, AgencyPair{phone, telecom})
-    }
-
-    graph := NewGraph(list)
-
-    // Second half of TGF format: Edge definitions
-    for scanner.Scan() {
-
-        data := strings.Fields(scanner.Text())
-        node1 := AgencyPair{data[0], graph.Telecom(data[0])}
-        node2 := AgencyPair{data[1], graph.Telecom(data[1])}
-        weight, _ := strconv.Atoi(data[2])
-
-        graph.AddEdge(node1, node2, weight)
-    }
-
-    return graph, scanner.Err()
+    g.telecoms[node.ID()] = node.Telecom
 }
@@ -0,0 +1,151 @@
+package lib
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// ParseError reports a malformed line of a graph file
+type ParseError struct {
+    File    string
+    Line    int
+    Msg     string
+}
+
+func (e *ParseError) Error() string {
+    return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// ReadGraph reads a TGF file, failing on the first malformed line
+func ReadGraph (path string) (*TelecomGraph, error) {
+    graph, _, err := readTGFFile(path, true)
+    return graph, err
+}
+
+// ReadGraphLenient reads a TGF file, skipping malformed lines and returning
+// them as warnings instead
+func ReadGraphLenient (path string) (*TelecomGraph, []error, error) {
+    return readTGFFile(path, false)
+}
+
+func readTGFFile (path string, strict bool) (*TelecomGraph, []error, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+    return ParseTGF(file, path, strict)
+}
+
+// ParseTGF reads a graph in TGF format from r; name is used in error messages.
+// Node lines are "identifier telecom" and edge lines "identifier identifier
+// weight", separated by a line holding "#".  In strict mode the first bad line
+// is returned as the error, otherwise bad lines are skipped and collected as
+// warnings.
+func ParseTGF (r io.Reader, name string, strict bool) (*TelecomGraph, []error, error) {
+    var warnings []error
+    graph := NewGraph(nil)
+    declared := make(map[string]int)
+    scanner := bufio.NewScanner(r)
+    lineNo := 0
+
+    // Records a bad line, returning true if parsing has to stop
+    fail := func(format string, args ...interface{}) bool {
+        warnings = append(warnings, &ParseError{name, lineNo, fmt.Sprintf(format, args...)})
+        return strict
+    }
+
+    // First half of the TGF format:  Node definitions
+    for scanner.Scan() {
+        lineNo++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+
+        // Check for seperator
+        if line == "#" {
+            break
+        }
+
+        // Otherwise split into its components and form a pair; the
+        // identifier may carry a kind prefix such as "imsi:"
+        data := strings.Fields(line)
+        if len(data) != 2 {
+            if fail("expected \"identifier telecom\", got %d fields", len(data)) {
+                return nil, nil, warnings[0]
+            }
+            continue
+        }
+        telecom, err := strconv.Atoi(data[1])
+        if err != nil || telecom < 0 {
+            if fail("invalid telecom %q for node %s", data[1], data[0]) {
+                return nil, nil, warnings[0]
+            }
+            continue
+        }
+
+        pair := NewPair(data[0], telecom)
+        if first, ok := declared[pair.ID()]; ok {
+            if fail("duplicate node %s (first declared on line %d)", data[0], first) {
+                return nil, nil, warnings[0]
+            }
+            continue
+        }
+        declared[pair.ID()] = lineNo
+        graph.AddNode(pair)
+    }
+
+    // Second half of TGF format: Edge definitions
+    for scanner.Scan() {
+        lineNo++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+
+        data := strings.Fields(line)
+        if len(data) != 3 {
+            if fail("expected \"identifier identifier weight\", got %d fields", len(data)) {
+                return nil, nil, warnings[0]
+            }
+            continue
+        }
+
+        unknown := ""
+        for _, id := range data[:2] {
+            if _, ok := declared[NewPair(id, 0).ID()]; !ok {
+                unknown = id
+                break
+            }
+        }
+        if unknown != "" {
+            if fail("edge refers to undeclared node %s", unknown) {
+                return nil, nil, warnings[0]
+            }
+            continue
+        }
+
+        weight, err := strconv.Atoi(data[2])
+        if err != nil || weight < 0 {
+            if fail("invalid weight %q", data[2]) {
+                return nil, nil, warnings[0]
+            }
+            continue
+        }
+
+        node1 := NewPair(data[0], graph.Telecom(data[0]))
+        node2 := NewPair(data[1], graph.Telecom(data[1]))
+        graph.AddEdge(node1, node2, weight)
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, warnings, fmt.Errorf("%s:%d: %v", name, lineNo + 1, err)
+    }
+    return graph, warnings, nil
+}
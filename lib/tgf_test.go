@@ -0,0 +1,54 @@
+package lib
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestTGFParserErrors(t *testing.T) {
+    cases := []struct {
+        input   string
+        err     string
+    }{
+        {"1234567890\n#\n", "bad.tgf:1: expected \"identifier telecom\""},
+        {"1234567890 zero\n#\n", "bad.tgf:1: invalid telecom \"zero\""},
+        {"1234567890 0\n\n1234567890 1\n#\n", "bad.tgf:3: duplicate node 1234567890 (first declared on line 1)"},
+        {"1234567890 0\n#\n1234567890 1234567891 1\n", "bad.tgf:3: edge refers to undeclared node 1234567891"},
+        {"1234567890 0\n1234567891 0\n#\n1234567890 1234567891 heavy\n", "bad.tgf:4: invalid weight \"heavy\""},
+        {"1234567890 0\n1234567891 0\n#\n1234567890 1234567891\n", "bad.tgf:4: expected \"identifier identifier weight\""},
+    }
+
+    for _, c := range cases {
+        graph, _, err := ParseTGF(strings.NewReader(c.input), "bad.tgf", true)
+        if err == nil || graph != nil {
+            panic("ERROR: malformed graph accepted: " + c.input)
+        }
+        if !strings.HasPrefix(err.Error(), c.err) {
+            panic("ERROR: unexpected parse error: " + err.Error())
+        }
+    }
+
+    println("PASS: TGF strict parser test")
+}
+
+func TestTGFParserLenient(t *testing.T) {
+    input := "1234567890 0\n1234567891 1\n1234567891 0\nbogus\n#\n" +
+             "1234567890 1234567891 1\n1234567890 1234567899 1\n1234567890 1234567891 x\n"
+
+    graph, warnings, err := ParseTGF(strings.NewReader(input), "lenient.tgf", false)
+    if err != nil {
+        panic("ERROR: lenient parse failed: " + err.Error())
+    }
+    if len(warnings) != 4 {
+        panic("ERROR: expected 4 warnings")
+    }
+    if graph.NumNodes != 2 || graph.Telecom("1234567891") != 1 {
+        panic("ERROR: lenient parse kept wrong nodes")
+    }
+    if !graph.ContainsEdge(AgencyPair{"1234567890", 0, KindPhone}, AgencyPair{"1234567891", 1, KindPhone}) ||
+       len(graph.Neighbors(AgencyPair{"1234567890", 0, KindPhone})) != 1 {
+        panic("ERROR: lenient parse kept wrong edges")
+    }
+
+    println("PASS: TGF lenient parser test")
+}
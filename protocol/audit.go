@@ -0,0 +1,162 @@
+package protocol
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "github.com/hm16083/ppcc/lib"
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+    "gopkg.in/dedis/onet.v1/log"
+)
+
+// Events recorded in the audit logs
+const (
+    AuditWarrant            = "warrant"
+    AuditQuerySent          = "query-sent"
+    AuditQueryReceived      = "query-received"
+    AuditQueryRejected      = "query-rejected"
+    AuditQueryAnswered      = "query-answered"
+    AuditQueryUnanswered    = "query-unanswered"
+    AuditResultDecrypted    = "result-decrypted"
+    AuditDone               = "done"
+)
+
+// AuditDir is the directory where nodes keep their audit log files, and the
+// keys signing them.  If it is empty, audit logs are only kept in memory.
+var AuditDir = ""
+
+// AuditPassphrase encrypts the key files of the audit logs in AuditDir, which
+// requires it
+var AuditPassphrase = ""
+
+// auditLogs holds the audit log of every node of this process, by public
+// key, so that a node keeps a single log across protocol instances, and the
+// published key signing the log of every node known
+var auditLogs = struct {
+    sync.Mutex
+    m       map[string]*lib.AuditLog
+    keys    map[string]abstract.Point
+}{m: make(map[string]*lib.AuditLog), keys: make(map[string]abstract.Point)}
+
+// AuditLog returns the audit log of the node with the given public key, or
+// nil if the node has not run the protocol.  The log is signed with a key of
+// its own, whose public half is the log's Public.
+func AuditLog(public abstract.Point) *lib.AuditLog {
+    auditLogs.Lock()
+    defer auditLogs.Unlock()
+    return auditLogs.m[public.String()]
+}
+
+// AuditKey returns the published key signing the audit log of the node with
+// the given public key, against which auditors check the log
+func AuditKey(public abstract.Point) (abstract.Point, bool) {
+    auditLogs.Lock()
+    defer auditLogs.Unlock()
+    key, ok := auditLogs.keys[public.String()]
+    return key, ok
+}
+
+// PublishAuditKey records the key signing the audit log of a node, such as a
+// node of another process.  A node keeps the key of its log, so once a key
+// is known, another is refused.
+func PublishAuditKey(public, key abstract.Point) error {
+    auditLogs.Lock()
+    defer auditLogs.Unlock()
+    return publishAuditKey(public, key)
+}
+
+func publishAuditKey(public, key abstract.Point) error {
+    if known, ok := auditLogs.keys[public.String()]; ok && !known.Equal(key) {
+        return fmt.Errorf("another audit key of %v was published", public)
+    }
+    auditLogs.keys[public.String()] = key
+    return nil
+}
+
+// openAuditLog returns the audit log of this node, opening it if needed
+func (p *PPCC) openAuditLog() (*lib.AuditLog, error) {
+    auditLogs.Lock()
+    defer auditLogs.Unlock()
+
+    key := p.Public().String()
+    if l := auditLogs.m[key]; l != nil {
+        return l, nil
+    }
+
+    if AuditDir == "" {
+        l := lib.NewAuditLog(p.Suite(), p.Suite().Scalar().Pick(random.Stream))
+        if err := publishAuditKey(p.Public(), l.Public); err != nil {
+            return nil, err
+        }
+        auditLogs.m[key] = l
+        return l, nil
+    }
+    prefix, err := p.auditPrefix()
+    if err != nil {
+        return nil, err
+    }
+    path := prefix + ".audit"
+    signKey, err := auditKey(p.Suite(), filepath.Base(prefix), path + ".key")
+    if err != nil {
+        return nil, err
+    }
+    l, err := lib.OpenAuditLog(path, p.Suite(), signKey)
+    if err != nil {
+        return nil, err
+    }
+    if err := lib.WritePublicKeys(path + ".pub", []abstract.Point{l.Public}); err != nil {
+        return nil, err
+    }
+    if err := publishAuditKey(p.Public(), l.Public); err != nil {
+        return nil, err
+    }
+    auditLogs.m[key] = l
+    return l, nil
+}
+
+// auditPrefix is the path, without extension, of the files this node keeps
+// in AuditDir, or "" without one
+func (p *PPCC) auditPrefix() (string, error) {
+    if AuditDir == "" {
+        return "", nil
+    }
+    buf, err := p.Public().MarshalBinary()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(AuditDir, fmt.Sprintf("%s-%x", p.name(), buf[:4])), nil
+}
+
+// auditKey returns the key signing an audit log, read from the key file at
+// path, or created there with the log.  The file is encrypted with
+// AuditPassphrase.  It is not the node's key, which decrypts messages, and
+// the log's public key is written next to the log for its auditors.
+func auditKey(suite abstract.Suite, node, path string) (abstract.Scalar, error) {
+    if AuditPassphrase == "" {
+        return nil, errors.New("no passphrase for the audit keys")
+    }
+    ring, err := lib.LoadKeyring(suite, path, node, AuditPassphrase)
+    if os.IsNotExist(err) {
+        ring = lib.NewKeyring(suite, node)
+        err = ring.Save(path, AuditPassphrase)
+    }
+    if err != nil {
+        return nil, err
+    }
+    key := ring.Current()
+    if key == nil {
+        return nil, fmt.Errorf("no valid key in audit key file %s", path)
+    }
+    return key.SignKey, nil
+}
+
+// audit appends a record to the audit log of this node
+func (p *PPCC) audit(event, warrant string, query int, detail string) {
+    if _, err := p.auditLog.Append(p.name(), event, warrant, query, detail); err != nil {
+        log.Error("could not write audit record:", err)
+    }
+}
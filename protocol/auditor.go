@@ -0,0 +1,411 @@
+package protocol
+
+import (
+    "bytes"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/hm16083/ppcc/lib"
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/onet.v1"
+    "gopkg.in/dedis/onet.v1/log"
+    "gopkg.in/dedis/onet.v1/network"
+)
+
+// auditorEnabled makes the last node of the tree an auditor
+var auditorEnabled = false
+
+// SetAuditor makes the last node of the tree an auditor in the protocol
+// instances created afterwards.  The agency and the telecoms send it a copy
+// of every warrant, query, reply and reject, sealed with its key and signed
+// with their own.
+func SetAuditor(enabled bool) {
+    auditorEnabled = enabled
+}
+
+// TranscriptEntry is a protocol message received by the auditor; exactly
+// one of the message fields is set.  Sender is the index of the sending node
+// in the tree, and VerifyKey the key it signed the transcript with.
+type TranscriptEntry struct {
+    Sender      int
+    VerifyKey   abstract.Point
+    Warrant     *Warrant
+    Query       *AuthorityQuery
+    Reply       *Reply
+    Reject      *Reject
+    Released    *Released
+}
+
+// AuditReport holds what the auditor received about a warrant, and the
+// problems it found
+type AuditReport struct {
+    WarrantID   string
+    Entries     []TranscriptEntry
+    Problems    []string
+}
+
+// auditReports holds the final reports of the auditors of this process
+var auditReports = struct {
+    sync.Mutex
+    m   map[string]*AuditReport
+}{m: make(map[string]*AuditReport)}
+
+// AuditorReport returns the report of the auditor on a warrant, or nil if
+// the auditor has not finished checking it
+func AuditorReport(warrantID string) *AuditReport {
+    auditReports.Lock()
+    defer auditReports.Unlock()
+    return auditReports.m[warrantID]
+}
+
+// auditorState is the state of the auditor node.  received counts the
+// transcripts of every node, and reported how many the node says it sent.
+type auditorState struct {
+    report      *AuditReport
+    received    map[int]int
+    reported    map[int]int
+    doneAt      time.Time
+}
+
+func newAuditorState() *auditorState {
+    return &auditorState{received: make(map[int]int), reported: make(map[int]int)}
+}
+
+// reportTranscripts tells the auditor how many transcripts a telecom sent
+func (p *PPCC) reportTranscripts() {
+    if p.IsRoot() || p.IsAuditor || p.Auditor == nil {
+        return
+    }
+    if err := p.SendTo(p.Auditor, &Done{Transcripts: p.transcripts, Suite: p.Suite().String()}); err != nil {
+        log.Error("could not report transcripts:", err)
+    }
+}
+
+// sendTranscript sends a copy of a message to the auditor, if any
+func (p *PPCC) sendTranscript(warrantID string, msg interface{}) {
+    if p.Auditor == nil {
+        return
+    }
+    buf, err := network.Marshal(msg)
+    if err != nil {
+        log.Error("could not marshal transcript:", err)
+        return
+    }
+    sealed, err := lib.Seal(p.Suite(), p.Auditor.ServerIdentity.Public, buf)
+    if err != nil {
+        log.Error("could not seal transcript:", err)
+        return
+    }
+
+    p.transcripts++
+    err = p.sendTo(p.Auditor, &Transcript{
+        WarrantID:  warrantID,
+        Sender:     p.index,
+        Sealed:     sealed,
+        Suite:      p.Suite().String(),
+        Signature:  p.ppcc.SignMessage(string(buf)),
+        VerifyKey:  p.ppcc.VerifyKey,
+    })
+    if err != nil {
+        log.Error("could not send transcript:", err)
+    }
+}
+
+func (p *PPCC) handleTranscript(in *Transcript) error {
+    if !p.IsAuditor {
+        return fmt.Errorf("non-auditor received transcript")
+    }
+    a := p.auditor
+    if a.report == nil {
+        a.report = &AuditReport{WarrantID: in.WarrantID}
+    }
+    report := a.report
+    problem := func(format string, args ...interface{}) {
+        report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+    }
+
+    if in.WarrantID != report.WarrantID {
+        problem("transcript of warrant %q in run of warrant %q", in.WarrantID, report.WarrantID)
+    }
+    if err := p.checkSuite(in.Suite); err != nil {
+        problem("transcript from node %d: %v", in.Sender, err)
+        return p.checkAuditDone()
+    }
+    if in.Sender < 0 || in.Sender >= len(p.publics) {
+        problem("transcript from unknown node %d", in.Sender)
+        return p.checkAuditDone()
+    }
+    a.received[in.Sender]++
+    buf, err := lib.Open(p.Suite(), p.Private(), in.Sealed)
+    if err != nil {
+        problem("could not open transcript from node %d: %v", in.Sender, err)
+        return p.checkAuditDone()
+    }
+    if in.VerifyKey == nil {
+        problem("transcript from node %d without a key", in.Sender)
+        return p.checkAuditDone()
+    }
+    if err := lib.SchnorrVerify(p.Suite(), buf, in.VerifyKey, in.Signature); err != nil {
+        problem("transcript from node %d does not verify: %v", in.Sender, err)
+        return p.checkAuditDone()
+    }
+    if err := checkSigner(p.publics[in.Sender], in.VerifyKey); err != nil {
+        problem("transcript from node %d %v", in.Sender, err)
+        return p.checkAuditDone()
+    }
+    _, msg, err := network.Unmarshal(buf)
+    if err != nil {
+        problem("could not read transcript from node %d: %v", in.Sender, err)
+        return p.checkAuditDone()
+    }
+
+    entry := TranscriptEntry{Sender: in.Sender, VerifyKey: in.VerifyKey}
+    switch m := msg.(type) {
+    case *Warrant:
+        entry.Warrant = m
+    case *AuthorityQuery:
+        entry.Query = m
+    case *Reply:
+        entry.Reply = m
+    case *Reject:
+        entry.Reject = m
+    case *Released:
+        entry.Released = m
+    default:
+        problem("transcript from node %d holds a %T", in.Sender, msg)
+        return p.checkAuditDone()
+    }
+    report.Entries = append(report.Entries, entry)
+    return p.checkAuditDone()
+}
+
+// handleAuditDone records how many transcripts the agency or a telecom sent
+func (p *PPCC) handleAuditDone(from *onet.TreeNode, in *Done) error {
+    sender := -1
+    for i, public := range p.publics[:numAuthorities + p.NumTelecoms] {
+        if public.Equal(from.ServerIdentity.Public) {
+            sender = i
+        }
+    }
+    if sender < 0 {
+        return fmt.Errorf("auditor received done message from unknown node")
+    }
+    p.auditor.reported[sender] = in.Transcripts
+    if sender == 0 {
+        p.auditor.doneAt = time.Now()
+    }
+    return p.checkAuditDone()
+}
+
+// checkAuditDone checks the transcripts and publishes the report once the
+// agency is done and every node reported its transcripts, which all
+// arrived, or after QueryTimeout for transcripts and reports that got lost
+func (p *PPCC) checkAuditDone() error {
+    a := p.auditor
+    if a.doneAt.IsZero() {
+        return nil
+    }
+    nodes := numAuthorities + p.NumTelecoms
+    complete := true
+    for i := 0; i < nodes; i++ {
+        if n, ok := a.reported[i]; !ok || a.received[i] < n {
+            complete = false
+        }
+    }
+    if !complete && time.Since(a.doneAt) < p.QueryTimeout {
+        return nil
+    }
+
+    if a.report == nil {
+        a.report = &AuditReport{}
+    }
+    report := a.report
+    for i := 0; i < nodes; i++ {
+        n, ok := a.reported[i]
+        switch {
+        case !ok:
+            report.Problems = append(report.Problems, fmt.Sprintf("node %d did not report its transcripts", i))
+        case a.received[i] != n:
+            report.Problems = append(report.Problems, fmt.Sprintf("received %d of %d transcripts from node %d", a.received[i], n, i))
+        }
+    }
+    report.Problems = append(report.Problems, CheckTranscripts(p.Suite(), p.publics, report.Entries)...)
+    for _, problem := range report.Problems {
+        log.Lvl1("Auditor: warrant", report.WarrantID, ":", problem)
+    }
+
+    auditReports.Lock()
+    auditReports.m[report.WarrantID] = report
+    auditReports.Unlock()
+    p.NodeDone = true
+    return nil
+}
+
+// isRetry tells whether a query resends another: it differs from it only by
+// its sequence number and signature
+func isRetry(first, q *AuthorityQuery) bool {
+    retry := *first
+    retry.Seq = q.Seq
+    return retry.signedFields() == q.signedFields() && retry.VerifyKey.Equal(q.VerifyKey)
+}
+
+// CheckTranscripts verifies that the queries of a run are consistent with its
+// warrant, and that the replies are signed by the telecoms queried, with the
+// key of their transcripts, and keep to the query and the warrant.  publics holds the keys of the nodes of the
+// tree.  It returns the problems found.
+func CheckTranscripts(suite abstract.Suite, publics []abstract.Point, entries []TranscriptEntry) []string {
+    var problems []string
+    problem := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    var warrant *Warrant
+    for _, e := range entries {
+        if e.Warrant == nil {
+            continue
+        }
+        if e.Sender != 0 {
+            problem("warrant sent by node %d", e.Sender)
+        } else if warrant != nil {
+            problem("more than one warrant")
+        }
+        warrant = e.Warrant
+    }
+    if warrant == nil {
+        return append(problems, "no warrant")
+    }
+
+    // The queries keep to the warrant, are signed with a single key and are
+    // numbered in a single session
+    queries := make(map[int]*AuthorityQuery)
+    var verifyKey abstract.Point
+    var session string
+    lastSeq := 0
+    for _, e := range entries {
+        q := e.Query
+        if q == nil {
+            continue
+        }
+        if e.Sender != 0 {
+            problem("query %d sent by node %d", q.ID, e.Sender)
+            continue
+        }
+        if first := queries[q.ID]; first != nil && !isRetry(first, q) {
+            problem("query ID %d reused", q.ID)
+        }
+        queries[q.ID] = q
+        if verifyKey == nil {
+            verifyKey = q.VerifyKey
+        }
+        if !verifyKey.Equal(q.VerifyKey) || lib.SchnorrVerify(suite, []byte(q.signedFields()), verifyKey, q.Signature) != nil {
+            problem("query %d not signed by the agency's key", q.ID)
+        }
+        if q.WarrantID != warrant.ID || fmt.Sprint(q.Kinds) != fmt.Sprint(warrant.Kinds) ||
+            q.Subgraph != warrant.Subgraph || q.MaxContacts != warrant.MaxContacts || q.MaxFanout != warrant.MaxFanout ||
+            q.WarrantDepth != warrant.Depth || q.Issuer != warrant.Issuer || q.Issued != warrant.Issued ||
+            !bytes.Equal(q.TargetCommitment, warrant.Commitment()) || !bytes.Equal(q.IssuerSignature, warrant.Signature) {
+            problem("query %d does not match the warrant", q.ID)
+        }
+        if q.Expires != warrant.Expires {
+            problem("query %d does not carry the warrant's expiry", q.ID)
+        }
+        if session == "" {
+            session = q.SessionID
+        } else if q.SessionID != session {
+            problem("query %d sent in session %q instead of %q", q.ID, q.SessionID, session)
+        }
+        if q.Seq <= lastSeq {
+            problem("query %d has sequence number %d, not above %d", q.ID, q.Seq, lastSeq)
+        }
+        lastSeq = q.Seq
+        if q.Depth < 0 || q.Depth > warrant.Depth {
+            problem("query %d has depth %d beyond the warrant's %d", q.ID, q.Depth, warrant.Depth)
+        }
+    }
+
+    // The replies are committed to by the telecoms queried, and release no
+    // more than the query and the warrant allow
+    replies := make(map[int]*Reply)
+    for _, e := range entries {
+        r := e.Reply
+        if r == nil {
+            continue
+        }
+        q := queries[r.ID]
+        if q == nil {
+            problem("reply to unknown query %d", r.ID)
+            continue
+        }
+
+        // A retried query is answered with the reply sent first
+        if first := replies[r.ID]; first != nil {
+            if first.signedFields() != r.signedFields() {
+                problem("conflicting replies to query %d", r.ID)
+            }
+            continue
+        }
+        replies[r.ID] = r
+        telecomNode := numAuthorities + q.Telecom
+        if e.Sender != telecomNode || telecomNode >= len(publics) {
+            problem("reply to query %d sent by node %d instead of telecom %d", r.ID, e.Sender, q.Telecom)
+            continue
+        }
+        if r.VerifyKey == nil || e.VerifyKey == nil || !r.VerifyKey.Equal(e.VerifyKey) ||
+            lib.SchnorrVerify(suite, []byte(r.signedFields()), r.VerifyKey, r.Signature) != nil {
+            problem("reply to query %d not signed by telecom %d", r.ID, q.Telecom)
+        }
+        if r.Depth != q.Depth {
+            problem("reply to query %d has depth %d instead of %d", r.ID, r.Depth, q.Depth)
+        }
+        if q.Depth == 0 && len(r.EncPhones) > 0 {
+            problem("reply to query %d releases contacts at depth 0", r.ID)
+        }
+        if warrant.MaxContacts > 0 && len(r.EncPhones) > q.Remaining {
+            problem("reply to query %d releases %d contacts, above the %d left of the budget", r.ID, len(r.EncPhones), q.Remaining)
+        }
+        if warrant.MaxFanout > 0 && len(r.EncPhones) > warrant.MaxFanout {
+            problem("reply to query %d releases %d contacts, above the fan-out limit", r.ID, len(r.EncPhones))
+        }
+        if len(r.EncEdges) > 0 && !warrant.Subgraph {
+            problem("reply to query %d releases calls without a subgraph warrant", r.ID)
+        }
+    }
+
+    // The telecoms together release no more distinct contacts than the
+    // warrant's budget
+    released := make(map[string]bool)
+    records := make(map[int]bool)
+    for _, e := range entries {
+        rel := e.Released
+        if rel == nil {
+            continue
+        }
+        r, q := replies[rel.ID], queries[rel.ID]
+        if r == nil || q == nil {
+            problem("contacts released for unknown reply %d", rel.ID)
+            continue
+        }
+        if e.Sender != numAuthorities + q.Telecom {
+            problem("contacts of reply %d reported by node %d instead of telecom %d", rel.ID, e.Sender, q.Telecom)
+            continue
+        }
+        if len(rel.Contacts) != len(r.EncPhones) {
+            problem("reply %d releases %d contacts, %d reported", rel.ID, len(r.EncPhones), len(rel.Contacts))
+        }
+        records[rel.ID] = true
+        for _, c := range rel.Contacts {
+            released[fmt.Sprintf("%x", c)] = true
+        }
+    }
+    for id, r := range replies {
+        if !records[id] && len(r.EncPhones) > 0 {
+            problem("contacts of reply %d not reported", id)
+        }
+    }
+    if limit := releaseLimit(warrant.MaxContacts); limit >= 0 && len(released) > limit {
+        problem("telecoms released %d distinct contacts, above the budget of %d", len(released), limit)
+    }
+
+    return problems
+}
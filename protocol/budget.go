@@ -0,0 +1,63 @@
+package protocol
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "sync"
+
+    "github.com/hm16083/ppcc/lib"
+)
+
+// ledgers holds the ledger of every node of this process, by name: what a
+// telecom released under every warrant, and what the agency learned.  Like
+// the graphs, they outlive protocol instances, so that running a warrant
+// again does not get past its budget.  Every telecom keeps its own budget;
+// the agency enforces the total across telecoms, and the auditor checks it.
+var ledgers = struct {
+    sync.Mutex
+    m   map[string]*lib.Ledger
+}{m: make(map[string]*lib.Ledger)}
+
+// ledger returns the ledger of this node
+func (p *PPCC) ledger() *lib.Ledger {
+    return ledger(p.name())
+}
+
+// ledger returns the ledger of the node of the given name
+func ledger(name string) *lib.Ledger {
+    ledgers.Lock()
+    defer ledgers.Unlock()
+    l := ledgers.m[name]
+    if l == nil {
+        l = lib.NewLedger()
+        ledgers.m[name] = l
+    }
+    return l
+}
+
+// releaseHash stands for a released contact in the transcripts, so that the
+// auditor can count the distinct contacts released under a warrant
+func releaseHash(warrantID, id string) []byte {
+    h := sha256.Sum256([]byte(warrantID + "|" + id))
+    return h[:]
+}
+
+// releaseLimit is the number of contacts the telecoms may release under a
+// warrant revealing up to maxContacts, the target included, or -1 for no
+// limit
+func releaseLimit(maxContacts int) int {
+    if maxContacts <= 0 {
+        return -1
+    }
+    return maxContacts - 1
+}
+
+// randomID returns a random ID for a warrant or a session
+func randomID() string {
+    buf := make([]byte, 8)
+    if _, err := rand.Read(buf); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(buf)
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+    "time"
+
+    "gopkg.in/dedis/onet.v1/log"
+)
+
+// hardenedBudget is the time a telecom in hardened mode spends on every
+// query; 0 disables hardened mode
+var hardenedBudget time.Duration
+
+// SetHardened puts the telecoms of the protocol instances created afterwards
+// in hardened mode, or out of it for a budget of 0.  A hardened telecom
+// answers every query, rejected or not, budget after receiving it, or a
+// multiple of budget if it took longer, so that its response time does not
+// tell whether a number exists or how many neighbors it has.  It also echoes the queried identifier by
+// re-encrypting its points, so that a ciphertext that does not decrypt gets
+// the same reply as a number it does not hold.
+func SetHardened(budget time.Duration) {
+    hardenedBudget = budget
+}
+
+// afterBudget runs send, the answer to the current query, once the budget
+// since its receipt is spent.  The answer goes out from the Dispatch loop,
+// which handles other messages in the meantime.  A query that took longer
+// than the budget is answered at the next multiple of it, so that its timing
+// tells no more than how many budgets it took.
+func (p *PPCC) afterBudget(send func() error) error {
+    if hardenedBudget == 0 || p.queryReceived.IsZero() {
+        return send()
+    }
+    elapsed := time.Since(p.queryReceived)
+    if elapsed > hardenedBudget {
+        p.measure.overBudget++
+        log.Lvl1("Telecom", p.TelecomIdx, "took", elapsed, "over its budget of", hardenedBudget)
+    }
+    p.held++
+    time.AfterFunc(budgetDelay(elapsed, hardenedBudget), func() {
+        p.delayed <- send
+    })
+    return nil
+}
+
+// budgetDelay is how long to hold back an answer that took elapsed, to send
+// it at a multiple of the budget
+func budgetDelay(elapsed, budget time.Duration) time.Duration {
+    budgets := (elapsed + budget - 1) / budget
+    if budgets == 0 {
+        budgets = 1
+    }
+    return budgets * budget - elapsed
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/hm16083/ppcc/lib"
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+    "gopkg.in/dedis/onet.v1"
+    "gopkg.in/dedis/onet.v1/network"
+)
+
+// keys holds the keyrings of the nodes of this process, and the published
+// keys of every node known, by server identity.  Nodes without a keyring use
+// their server identity's key for encryption and, for signing, a key of
+// their own kept for the life of the process and published with it.  A node
+// with a keyring refuses the messages encrypted for its server identity, so
+// its peers, such as nodes of other processes, have to know its published
+// keys.
+var keys = struct {
+    sync.Mutex
+    rings       map[string]*lib.Keyring
+    signKeys    map[string]abstract.Scalar
+    published   map[string]lib.PublishedKeys
+}{rings: make(map[string]*lib.Keyring), signKeys: make(map[string]abstract.Scalar),
+    published: make(map[string]lib.PublishedKeys)}
+
+// SetKeyring makes the node with the given server identity use a keyring in
+// the protocol instances created afterwards, and publishes its keys.  It has
+// to be called again after the keyring is rotated.
+func SetKeyring(identity abstract.Point, ring *lib.Keyring) error {
+    published := ring.Publish()
+    if len(published.Keys) == 0 {
+        return errors.New("no valid key in keyring")
+    }
+    keys.Lock()
+    keys.rings[identity.String()] = ring
+    keys.published[identity.String()] = published
+    keys.Unlock()
+    return nil
+}
+
+// PublishKeys records the published keys of a node, such as a node of
+// another process.  The keys must be signed with every key they hold and,
+// once keys of the node are known, with one of those.
+func PublishKeys(identity abstract.Point, published lib.PublishedKeys) error {
+    if err := lib.VerifyPublishedKeys(network.Suite, published); err != nil {
+        return err
+    }
+    keys.Lock()
+    defer keys.Unlock()
+    if known, ok := keys.published[identity.String()]; ok {
+        trusted := false
+        for _, k := range published.Keys {
+            if known.HasVerifyKey(k.VerifyKey, time.Now()) {
+                trusted = true
+            }
+        }
+        if !trusted {
+            return fmt.Errorf("keys of %s not signed by a known key", published.Node)
+        }
+    }
+    keys.published[identity.String()] = published
+    return nil
+}
+
+// PublishedKeys returns the published keys of the node with the given server
+// identity
+func PublishedKeys(identity abstract.Point) (lib.PublishedKeys, bool) {
+    keys.Lock()
+    defer keys.Unlock()
+    published, ok := keys.published[identity.String()]
+    return published, ok
+}
+
+func keyring(identity abstract.Point) *lib.Keyring {
+    keys.Lock()
+    defer keys.Unlock()
+    return keys.rings[identity.String()]
+}
+
+// identitySignKey returns the signing key of a node without a keyring,
+// publishing it the first time
+func identitySignKey(n *onet.TreeNodeInstance) abstract.Scalar {
+    keys.Lock()
+    defer keys.Unlock()
+    identity := n.Public().String()
+    if key, ok := keys.signKeys[identity]; ok {
+        return key
+    }
+    key := n.Suite().Scalar().Pick(random.Stream)
+    keys.signKeys[identity] = key
+    keys.published[identity] = lib.PublishIdentity(n.Suite(), identity, n.Public(), key)
+    return key
+}
+
+// checkSigner verifies that a node that published its keys signs with one of
+// them
+func checkSigner(identity, verifyKey abstract.Point) error {
+    published, ok := PublishedKeys(identity)
+    if ok && (verifyKey == nil || !published.HasVerifyKey(verifyKey, time.Now())) {
+        return errors.New("not signed with a published key")
+    }
+    return nil
+}
+
+// newCrypto sets up the cryptographic state of a node: messages are encrypted
+// for the current published key of their recipient, or for its server
+// identity if it published none
+func newCrypto(n *onet.TreeNodeInstance, publics []abstract.Point) (*lib.PPCC, error) {
+    encKeys := make([]abstract.Point, len(publics))
+    versions := make([]int, len(publics))
+    for i, public := range publics {
+        encKeys[i] = public
+        if published, ok := PublishedKeys(public); ok {
+            if current := published.Current(time.Now()); current != nil {
+                encKeys[i] = current.Public
+                versions[i] = current.Version
+            }
+        }
+    }
+
+    ring := keyring(n.Public())
+    if ring == nil {
+        c := lib.NewPPCC(n.Suite(), n.Private(), encKeys)
+        c.SetKeyVersions(versions)
+        c.SetSignKey(identitySignKey(n))
+        return c, nil
+    }
+    return lib.NewKeyedPPCC(n.Suite(), ring, encKeys, versions)
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+    "fmt"
+    "time"
+
+    "gopkg.in/dedis/onet.v1"
+    "gopkg.in/dedis/onet.v1/network"
+)
+
+// RecordMeasure reports a named measurement.  It does nothing by default;
+// the simulation points it at the onet monitor.
+var RecordMeasure = func(name string, value float64) {}
+
+// measurements collects what a node reports once the protocol ends
+type measurements struct {
+    networkWait     time.Duration
+    queries         int
+    suppressed      int
+    overBudget      int
+    decryptFailures int
+    bytesSent       map[string]int
+    sentAt          map[int]time.Time
+    hopLatencies    []time.Duration
+}
+
+func newMeasurements() *measurements {
+    return &measurements{
+        bytesSent:  make(map[string]int),
+        sentAt:     make(map[int]time.Time),
+    }
+}
+
+// name is the prefix of the measurements of this node
+func (p *PPCC) name() string {
+    if p.IsRoot() {
+        return "agency"
+    }
+    if p.IsAuditor {
+        return "auditor"
+    }
+    return fmt.Sprintf("telecom%d", p.TelecomIdx)
+}
+
+// measureBytes makes sendTo count the bytes sent to every node
+var measureBytes = false
+
+// SetMeasureBytes makes the protocol instances created afterwards report the
+// bytes every node sends to every other.  Counting marshals every message a
+// second time, so it is off by default.
+func SetMeasureBytes(enabled bool) {
+    measureBytes = enabled
+}
+
+// sendTo sends a message and, if enabled, counts the bytes sent to its
+// destination
+func (p *PPCC) sendTo(tn *onet.TreeNode, msg interface{}) error {
+    if !measureBytes {
+        return p.send(tn, msg)
+    }
+    if buf, err := network.Marshal(msg); err == nil {
+        dest := "agency"
+        if tn == p.Auditor {
+            dest = "auditor"
+        }
+        for i, t := range p.Telecoms {
+            if t == tn {
+                dest = fmt.Sprintf("telecom%d", i)
+            }
+        }
+        p.measure.bytesSent[dest] += len(buf)
+    }
+    return p.send(tn, msg)
+}
+
+// decryptFailed counts a ciphertext that did not decrypt
+func (p *PPCC) decryptFailed() {
+    p.measure.decryptFailures++
+    if p.IsRoot() {
+        p.result.DecryptFailures++
+    }
+}
+
+// querySent and replyReceived time the hop of one query
+func (p *PPCC) querySent(id int) {
+    p.measure.queries++
+    p.measure.sentAt[id] = time.Now()
+}
+
+func (p *PPCC) replyReceived(id int) {
+    if sent, ok := p.measure.sentAt[id]; ok {
+        p.measure.hopLatencies = append(p.measure.hopLatencies, time.Since(sent))
+        delete(p.measure.sentAt, id)
+    }
+}
+
+// reportMeasurements records the measurements of this node through RecordMeasure
+func (p *PPCC) reportMeasurements() {
+    prefix := p.name() + "_"
+    s := p.ppcc.Stats
+    m := p.measure
+
+    RecordMeasure(prefix + "encrypt", s.EncryptTime.Seconds())
+    RecordMeasure(prefix + "encryptions", float64(s.Encryptions))
+    RecordMeasure(prefix + "decrypt", s.DecryptTime.Seconds())
+    RecordMeasure(prefix + "decryptions", float64(s.Decryptions))
+    RecordMeasure(prefix + "sign", s.SignTime.Seconds())
+    RecordMeasure(prefix + "signatures", float64(s.Signatures))
+    RecordMeasure(prefix + "verify", s.VerifyTime.Seconds())
+    RecordMeasure(prefix + "verifications", float64(s.Verifications))
+    RecordMeasure(prefix + "network_wait", m.networkWait.Seconds())
+    RecordMeasure(prefix + "queries", float64(m.queries))
+    RecordMeasure(prefix + "decrypt_failures", float64(m.decryptFailures))
+    if !p.IsRoot() {
+        RecordMeasure(prefix + "suppressed", float64(m.suppressed))
+        RecordMeasure(prefix + "over_budget", float64(m.overBudget))
+    }
+    for dest, bytes := range m.bytesSent {
+        RecordMeasure(prefix + "bytes_to_" + dest, float64(bytes))
+    }
+    for _, latency := range m.hopLatencies {
+        RecordMeasure("hop_latency", latency.Seconds())
+    }
+}
@@ -14,7 +14,14 @@ type StructInit struct {
 	Init
 }
 
+// Every message between nodes names the suite of its sender in Suite, which
+// the receiver checks against its own.
+
+// Done ends the protocol.  The agency and the telecoms also send it to the
+// auditor, with the number of transcripts they sent.
 type Done struct {
+    Transcripts     int
+    Suite           string
 }
 
 type StructDone struct {
@@ -22,10 +29,34 @@ type StructDone struct {
     Done
 }
 
+// Reply answers a query with the newly revealed neighbors, encrypted for
+// their telecoms, and the weights of the calls to them.  In subgraph mode the
+// calls to neighbors revealed before are listed too, encrypted for the agency.
+// Truncated and Exhausted report neighbors withheld by the fan-out limit and
+// by the contact budget of the warrant.  EncStatus tells the agency whether
+// the queried node was excluded as a hub.  The telecom signs the reply with
+// its signing key, committing to what it released.  With a transparency log,
+// Releases holds its signature of each neighbor, which the neighbor's telecom
+// checks before answering a query for it.
 type Reply struct {
+    ID             int
     EncQuery       lib.Ciphertext
-    EncPhones      []abstract.Point
+    EncStatus      lib.Ciphertext
+    EncPhones      []lib.Ciphertext
     Telecoms       []string
+    Weights        []int
+    Releases       [][]byte
+    Depth          int
+    Truncated      bool
+    Exhausted      bool
+
+    EncEdges       []lib.Ciphertext
+    EdgeTelecoms   []int
+    EdgeWeights    []int
+
+    Suite          string
+    Signature      []byte
+    VerifyKey      abstract.Point
 }
 
 type StructReply struct {
@@ -34,14 +65,91 @@ type StructReply struct {
 }
 
 type AuthorityQuery struct {
+    ID          int
     EncQuery    lib.Ciphertext
     Signature   []byte
     VerifyKey   abstract.Point
     Telecom     int
     Depth       int
+    Kinds       []lib.IDKind
+    Subgraph    bool
+    WarrantID   string
+    MaxContacts int
+    MaxFanout   int
+    Suite       string
+
+    // What the agency counts as left of the warrant's contact budget, across
+    // telecoms; the auditor checks that the agency counts right
+    Remaining   int
+
+    // Expiry of the warrant, and the session and sequence number the query
+    // is sent under
+    Expires     int64
+    SessionID   string
+    Seq         int
+
+    // The warrant's record in the transparency log, and its inclusion proof.
+    // TargetSalt opens the commitment to the target, and is only sent with
+    // the query for the target.
+    WarrantDepth        int
+    TargetCommitment    []byte
+    TargetSalt          []byte
+    Issuer              string
+    Issued              int64
+    IssuerSignature     []byte
+    LogIndex            int
+    LogProof            [][]byte
+    TreeHead            lib.SignedTreeHead
+
+    // The signature, with ReleaseKey, of the telecom ReleasedBy that released
+    // the queried contact to be queried at ReleaseDepth at most; nil for the
+    // target
+    Release             []byte
+    ReleaseKey          abstract.Point
+    ReleaseDepth        int
+    ReleasedBy          int
 }
 
 type StructAuthorityQuery struct {
     *onet.TreeNode
     AuthorityQuery
 }
+
+// Reject tells the agency that a telecom refuses to answer a query.  The
+// telecom signs it like a Reply.
+type Reject struct {
+    ID          int
+    Reason      string
+    Suite       string
+    Signature   []byte
+    VerifyKey   abstract.Point
+}
+
+type StructReject struct {
+    *onet.TreeNode
+    Reject
+}
+
+// Released goes to the auditor alone, with the transcript of a reply: it
+// holds a hash of every contact the reply released, in order, so that the
+// auditor can count distinct contacts across telecoms
+type Released struct {
+    ID          int
+    Contacts    [][]byte
+}
+
+// Transcript is a copy of a protocol message for the auditor, sealed with the
+// auditor's key and signed by its sender, the node at index Sender of the tree
+type Transcript struct {
+    WarrantID   string
+    Sender      int
+    Sealed      lib.Sealed
+    Suite       string
+    Signature   []byte
+    VerifyKey   abstract.Point
+}
+
+type StructTranscript struct {
+    *onet.TreeNode
+    Transcript
+}
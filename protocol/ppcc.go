@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
     "strconv"
+    "time"
 	"github.com/hm16083/ppcc/lib"
     "gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1"
@@ -16,6 +17,10 @@ func init() {
 	network.RegisterMessage(Init{})
 	network.RegisterMessage(Done{})
 	network.RegisterMessage(AuthorityQuery{})
+	network.RegisterMessage(Reject{})
+	network.RegisterMessage(Transcript{})
+	network.RegisterMessage(Warrant{})
+	network.RegisterMessage(Released{})
 	onet.GlobalProtocolRegister("PPCC", NewPPCC)
 }
 
@@ -28,10 +33,45 @@ func SetGraphs (subgraphs []lib.TelecomGraph) {
 
 var numAuthorities int = 1
 
+// Status of a queried node in a reply
+const (
+    statusOK        = "ok"
+    statusExcluded  = "excluded"
+)
+
+// Warrant names the target identifier (a phone number, or "kind:value" for
+// other identifier kinds), its telecom and the number of hops to chain.
+// Kinds restricts chaining to the listed identifier kinds; empty allows all.
+// Subgraph also reveals the calls among the contacts found, which the result
+// returns as a graph.
+//
+// MaxContacts caps the contacts revealed under the warrant, target included,
+// and MaxFanout the contacts revealed per reply; 0 means no limit.  The ID is
+// given by the issuer, and queries without one are rejected.  Every telecom
+// counts what it releases under the ID, and the agency what it learned
+// across telecoms; queries carry what is left of the budget, so running the
+// warrant again reveals no more contacts.  The auditor checks the total.
+//
+// Issuer and Issued (in Unix nanoseconds) identify who issued the warrant and
+// when; they are part of its record in the transparency log.  Telecoms do not
+// answer queries under the warrant after Expires (in Unix nanoseconds).  Only
+// a warrant issued through a transparency log may leave it 0, for no expiry.
+// Salt and Signature are set by IssueWarrant: the log records the target only
+// through a commitment under Salt, and Signature is the issuer's.
 type Warrant struct {
-    Phone   string
-    Telecom int
-    Depth   int
+    ID          string
+    Phone       string
+    Telecom     int
+    Depth       int
+    Kinds       []lib.IDKind
+    Subgraph    bool
+    MaxContacts int
+    MaxFanout   int
+    Issuer      string
+    Issued      int64
+    Expires     int64
+    Salt        []byte
+    Signature   []byte
 }
 
 // PPCC defines the channels and variables associated with the contact-chaining protocol
@@ -42,27 +82,65 @@ type PPCC struct {
     ChannelDone             chan StructDone
     ChannelReply            chan StructReply
     ChannelAuthorityQuery   chan StructAuthorityQuery
+    ChannelReject           chan StructReject
+    ChannelTranscript       chan StructTranscript
 
     NodeDone                bool
-    ProtocolDone            chan bool
+    ProtocolDone            chan *Result
+
+    // Queries unanswered after QueryTimeout are resent up to MaxRetries times
+    QueryTimeout            time.Duration
+    MaxRetries              int
 
     OutstandingPackets      int
 	Queue                   *lib.AgencyQueue
     CurrentDepth            int
+    nextQueryID             int
+    seq                     int
+    pending                 map[int]*pendingQuery
+    revealed                int
+    result                  *Result
 
     NumTelecoms             int
     Telecoms                []*onet.TreeNode
     Agency                  *onet.TreeNode
     InitWarrant             Warrant
 
-    OutputList              map[string]bool
+    // Queries are bound to a session, random unless set before Start, and
+    // numbered in the order they are sent
+    SessionID               string
+
+    // Inclusion proof of the warrant in the transparency log
+    logIndex                int
+    logProof                [][]byte
+    treeHead                lib.SignedTreeHead
+
+    // Auditor is nil unless SetAuditor enabled it
+    Auditor                 *onet.TreeNode
+    IsAuditor               bool
+    auditor                 *auditorState
+    index                   int
+    transcripts             int
+
 	TelecomIdx				int
     LocalSubgraph           *lib.TelecomGraph
+    queryReceived           time.Time
+    answered                map[string]*Reply
+
+    // Answers held back in hardened mode are sent on delayed, and counted in
+    // held until then
+    delayed                 chan func() error
+    held                    int
+
+    // send sends a message to a node, through onet unless a test wraps it
+    send                    func(*onet.TreeNode, interface{}) error
 
     ppcc                    *lib.PPCC
     publics                 []abstract.Point
     private                 abstract.Scalar
     verifyKey               abstract.Point
+    measure                 *measurements
+    auditLog                *lib.AuditLog
 }
 
 // NewPPCC initialises the structure for use in one round
@@ -74,26 +152,58 @@ func NewPPCC(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 
 	c := &PPCC{
 		TreeNodeInstance:   n,
-        ProtocolDone:       make(chan bool),
+        ProtocolDone:       make(chan *Result, 1),
+        QueryTimeout:       DefaultQueryTimeout,
+        MaxRetries:         DefaultRetries,
+        pending:            make(map[int]*pendingQuery),
+        answered:           make(map[string]*Reply),
+        delayed:            make(chan func() error),
+        result:             newResult(),
 	}
 
+    if err := checkRoster(n); err != nil {
+        return nil, err
+    }
+
     // Assign node number, public/private keys, and telecom subgraph
     totalNodes := len(n.List())
     numTelecoms := totalNodes - numAuthorities
+    if auditorEnabled {
+        numTelecoms--
+    }
+    if numTelecoms < 0 {
+        return nil, errors.New("tree too small for an auditor")
+    }
     telecoms := make([]*onet.TreeNode, numTelecoms)
     publics := make([]abstract.Point, totalNodes)
     j := 0
     for i, tn := range n.List() {
         publics[i] = tn.ServerIdentity.Public
+        if tn.ServerIdentity.Public.Equal(n.Public()) {
+            c.index = i
+        }
         if (tn.IsRoot()) {
             c.Agency = tn
             continue
         }
 
+        // The auditor is the last node
+        if auditorEnabled && i == totalNodes - 1 {
+            c.Auditor = tn
+            if tn.ServerIdentity.Public.Equal(n.Public()) {
+                c.IsAuditor = true
+                c.auditor = newAuditorState()
+            }
+            continue
+        }
+
+        // Telecoms without a graph are truncated away by the agency
         if tn.ServerIdentity.Public.Equal(n.Public()) {
 			c.TelecomIdx = j
-            local := globalGraphs[j]
-            c.LocalSubgraph = &local
+            if j < len(globalGraphs) {
+                local := globalGraphs[j]
+                c.LocalSubgraph = &local
+            }
 		}
 
         telecoms[j] = tn
@@ -104,14 +214,30 @@ func NewPPCC(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
         }
     }
 
-    c.ppcc = lib.NewPPCC(n.Suite(), n.Private(), publics)
+    ppcc, err := newCrypto(n, publics)
+    if err != nil {
+        return nil, errors.New("couldn't set up keys: " + err.Error())
+    }
+    c.ppcc = ppcc
+    c.send = n.SendTo
+    c.publics = publics
     c.NodeDone = false
     c.Telecoms = telecoms
     c.NumTelecoms = numTelecoms
+    if c.IsAuditor {
+        c.truncateTelecoms()
+    }
     c.OutstandingPackets = 0
+    c.SessionID = randomID()
+    c.measure = newMeasurements()
+    auditLog, err := c.openAuditLog()
+    if err != nil {
+        return nil, errors.New("couldn't open audit log: " + err.Error())
+    }
+    c.auditLog = auditLog
 
     // Register channels
-    err := c.RegisterChannel(&c.ChannelReply)
+    err = c.RegisterChannel(&c.ChannelReply)
 	if err != nil {
 		return nil, errors.New("couldn't register reply-channel: " + err.Error())
 	}
@@ -127,28 +253,66 @@ func NewPPCC(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	if err != nil {
 		return nil, errors.New("couldn't register done-channel: " + err.Error())
 	}
+	err = c.RegisterChannel(&c.ChannelReject)
+	if err != nil {
+		return nil, errors.New("couldn't register reject-channel: " + err.Error())
+	}
+	err = c.RegisterChannel(&c.ChannelTranscript)
+	if err != nil {
+		return nil, errors.New("couldn't register transcript-channel: " + err.Error())
+	}
 	return c, nil
 }
 
-// Start begins the protocol by giving the Agency an init message
+// Start begins the protocol by giving the Agency an init message.  The
+// message goes through Dispatch so that only one goroutine handles packets.
 func (p *PPCC) Start() error {
-    out := &Init{}
-	return p.handleInit(out)
+    p.ChannelInit <- StructInit{p.TreeNode(), Init{}}
+	return nil
 }
 
 func (p *PPCC) Dispatch() error {
+    // Only the agency waits on replies, and the auditor on transcripts
+    var timeouts <-chan time.Time
+    if p.IsRoot() || p.IsAuditor {
+        ticker := time.NewTicker(timeoutTick)
+        defer ticker.Stop()
+        timeouts = ticker.C
+    }
+
     for {
         // Invoke the handler function associated with the received packet
         var err error
+        wait := time.Now()
         select {
             case packet := <-p.ChannelReply:
+                p.measure.networkWait += time.Since(wait)
                 err = p.handleReply(&packet.Reply)
             case packet := <-p.ChannelInit:
                 err = p.handleInit(&packet.Init)
+                if err != nil && p.IsRoot() {
+                    p.result.Err = err
+                    p.NodeDone = true
+                }
             case packet := <-p.ChannelAuthorityQuery:
+                p.measure.networkWait += time.Since(wait)
                 err = p.handleAuthorityQuery(&packet.AuthorityQuery)
+            case packet := <-p.ChannelReject:
+                p.measure.networkWait += time.Since(wait)
+                err = p.handleReject(packet.TreeNode, &packet.Reject)
             case packet := <-p.ChannelDone:
-                err = p.handleDone(&packet.Done)
+                err = p.handleDone(packet.TreeNode, &packet.Done)
+            case packet := <-p.ChannelTranscript:
+                err = p.handleTranscript(&packet.Transcript)
+            case send := <-p.delayed:
+                p.held--
+                err = send()
+            case now := <-timeouts:
+                if p.IsAuditor {
+                    err = p.checkAuditDone()
+                } else {
+                    err = p.checkTimeouts(now)
+                }
         }
 
         if err != nil {
@@ -157,15 +321,25 @@ func (p *PPCC) Dispatch() error {
 
         if p.NodeDone && p.IsRoot() {
             log.Lvl3("Root is DONE")
-            p.ProtocolDone <- true
+            p.reportMeasurements()
+            p.result.finish()
+            p.audit(AuditDone, p.InitWarrant.ID, 0, fmt.Sprintf("%d contacts, %d queries, %d unanswered, exhausted %v",
+                len(p.result.Contacts), p.result.Queries, len(p.result.Unanswered), p.result.Exhausted))
+            p.ProtocolDone <- p.result
 
             for _, tn := range p.Telecoms {
-                p.SendTo(tn, &Done{})
+                p.SendTo(tn, &Done{Suite: p.Suite().String()})
+            }
+            if p.Auditor != nil {
+                p.SendTo(p.Auditor, &Done{Transcripts: p.transcripts, Suite: p.Suite().String()})
             }
             return nil
         }
 
-        if p.NodeDone {
+        // A telecom first sends the answers it holds back
+        if p.NodeDone && p.held == 0 {
+            p.reportTranscripts()
+            p.reportMeasurements()
             return nil
         }
     }
@@ -173,6 +347,18 @@ func (p *PPCC) Dispatch() error {
 
 var initSize int = 5
 
+// truncateTelecoms drops the telecoms without a graph, which the agency does
+// not query.  The auditor drops them alike, and expects no transcripts from
+// them.
+func (p *PPCC) truncateTelecoms() {
+    numGraphs := len(globalGraphs)
+    if numGraphs < p.NumTelecoms {
+        p.NumTelecoms = numGraphs
+        p.Telecoms = p.Telecoms[0:numGraphs]
+        log.Lvl3("Truncated Telecoms to length: ", len(p.Telecoms))
+    }
+}
+
 // Begins the protocol by dequeueing the first message (the warrant)
 func (p *PPCC) handleInit (in *Init) error {
 
@@ -181,19 +367,22 @@ func (p *PPCC) handleInit (in *Init) error {
     }
 
     // If we have more nodes than graphs, "truncate" the graph
-    numGraphs := len(globalGraphs)
-    if numGraphs < p.NumTelecoms {
-        p.NumTelecoms = numGraphs
-        p.Telecoms = p.Telecoms[0:numGraphs]
-        log.Lvl3("Truncated Telecoms to length: ", len(p.Telecoms))
-    }
+    p.truncateTelecoms()
 
-    // Initialize output list for agency
-    p.OutputList = make(map[string]bool)
+    // Initialize result and queue for agency
+    warrant := p.InitWarrant
+    if warrant.ID == "" {
+        return fmt.Errorf("warrant without an ID")
+    }
+    p.result.Warrant = warrant
+    p.result.Started = time.Now()
+    p.audit(AuditWarrant, warrant.ID, 0, fmt.Sprintf("target %s telecom %d depth %d kinds %v subgraph %v max contacts %d max fanout %d",
+        warrant.Phone, warrant.Telecom, warrant.Depth, warrant.Kinds, warrant.Subgraph, warrant.MaxContacts, warrant.MaxFanout))
+    p.sendTranscript(warrant.ID, &warrant)
+    p.proveWarrant()
     p.Queue = lib.NewQueue(initSize)
 
     // Start protocol by handling the first message (the warrant)
-    warrant := p.InitWarrant
     telecomIdx := warrant.Telecom
     p.CurrentDepth = warrant.Depth
     log.Lvl1("Started protocol with depth ", warrant.Depth)
@@ -202,28 +391,185 @@ func (p *PPCC) handleInit (in *Init) error {
     }
 
     // Encrypt components of the message under the telecoms public key
-    K, C, _ := p.ppcc.EncryptTelecomMessage(warrant.Phone, numAuthorities + telecomIdx)
+    encPhone, err := p.ppcc.EncryptTelecomMessage(warrant.Phone, numAuthorities + telecomIdx)
+    if err != nil {
+        return fmt.Errorf("could not encrypt warrant: %v", err)
+    }
+
+    // The contacts learned under the warrant in earlier runs count against
+    // its budget
+    p.Queue.Push(lib.NewTriple(encPhone, telecomIdx, warrant.Depth))
+    p.revealed = 1 + p.ledger().Released(warrant.ID)
+    return p.advance()
+}
+
+// advance sends the next queued query once the previous one is settled, and
+// ends the protocol when nothing is left to query
+func (p *PPCC) advance() error {
+    for p.OutstandingPackets == 0 && !p.Queue.IsEmpty() {
+        triple := p.Queue.Pop()
+        if triple.Telecom >= p.NumTelecoms {
+            p.giveUp(&pendingQuery{triple: triple}, "invalid telecom number")
+            continue
+        }
+        p.CurrentDepth = triple.Depth
+        p.OutstandingPackets++
+        p.sendQuery(&pendingQuery{triple: triple})
+    }
+
+    if p.OutstandingPackets == 0 && p.Queue.IsEmpty() {
+        p.NodeDone = true
+    }
+    return nil
+}
+
+// sendQuery signs a query for an encrypted identifier and sends it to the
+// identifier's telecom, under a fresh ID unless it is a retry, and under a
+// new sequence number.  Failed sends are retried when the query times out.
+func (p *PPCC) sendQuery(q *pendingQuery) {
+    triple := q.triple
+
+    // Once the budget is exhausted, the queued contacts are still
+    // identified, but none of their neighbors is revealed
+    depth := triple.Depth
+    if p.result.Exhausted {
+        depth = 0
+    }
 
     // Build authority packet to send to telecom
+    if q.id == 0 {
+        p.nextQueryID++
+        q.id = p.nextQueryID
+    }
+    p.seq++
+    p.refreshProof()
+    warrant := p.InitWarrant
     out := &AuthorityQuery {
-        EncQuery:   lib.Ciphertext{K, C},
-        Telecom:    warrant.Telecom,
-        Depth:      warrant.Depth,
+        ID:             q.id,
+        EncQuery:       triple.EncPhone,
+        Telecom:        triple.Telecom,
+        Depth:          depth,
+        Kinds:          warrant.Kinds,
+        Subgraph:       warrant.Subgraph,
+        WarrantID:      warrant.ID,
+        MaxContacts:    warrant.MaxContacts,
+        MaxFanout:      warrant.MaxFanout,
+        Remaining:      warrant.MaxContacts - p.revealed,
+        Suite:          p.Suite().String(),
+        WarrantDepth:   warrant.Depth,
+        Issuer:         warrant.Issuer,
+        Issued:         warrant.Issued,
+        Expires:        warrant.Expires,
+        SessionID:      p.SessionID,
+        Seq:            p.seq,
+        LogIndex:       p.logIndex,
+        LogProof:       p.logProof,
+        TreeHead:       p.treeHead,
+    }
+    out.TargetCommitment = warrant.Commitment()
+    out.IssuerSignature = warrant.Signature
+    if triple.Parent == nil {
+        out.TargetSalt = warrant.Salt
+    } else {
+        out.Release = triple.Release
+        out.ReleaseKey = triple.ReleaseKey
+        out.ReleaseDepth = triple.Depth
+        out.ReleasedBy = triple.Parent.Telecom
     }
 
     // Sign the fields of the message and attach the signature to the packet
-    str := fmt.Sprintf("%+v%+v%+v", out.EncQuery, out.Telecom, out.Depth)
-    out.Signature = p.ppcc.SignMessage(str)
+    out.Signature = p.ppcc.SignMessage(out.signedFields())
     out.VerifyKey = p.ppcc.VerifyKey
 
     // Send to telecom
-    err := p.SendTo(p.Telecoms[telecomIdx], out)
-    p.OutstandingPackets++
+    q.attempts++
+    q.sentAt = time.Now()
+    p.pending[out.ID] = q
+    p.querySent(out.ID)
+    p.result.Queries++
+    p.audit(AuditQuerySent, warrant.ID, out.ID, fmt.Sprintf("telecom %d depth %d attempt %d",
+        out.Telecom, out.Depth, q.attempts))
+    p.sendTranscript(warrant.ID, out)
+    err := p.sendTo(p.Telecoms[triple.Telecom], out)
     if err != nil {
-        log.Error("failed to send initial warant", err)
+        log.Error("failed to send warant", err)
     }
+}
 
-    return nil
+// settle removes a query that was answered or given up on
+func (p *PPCC) settle(q *pendingQuery) {
+    delete(p.pending, q.id)
+    p.OutstandingPackets--
+}
+
+// giveUp records a query as unanswered
+func (p *PPCC) giveUp(q *pendingQuery, reason string) {
+    log.Lvl1("Giving up on query", q.id, "to telecom", q.triple.Telecom, ":", reason)
+    p.audit(AuditQueryUnanswered, p.InitWarrant.ID, q.id, fmt.Sprintf("telecom %d: %s", q.triple.Telecom, reason))
+    p.result.Unanswered = append(p.result.Unanswered, UnansweredQuery{
+        ID:         q.id,
+        Telecom:    q.triple.Telecom,
+        Depth:      q.triple.Depth,
+        Attempts:   q.attempts,
+        Reason:     reason,
+    })
+}
+
+// checkTimeouts resends or gives up on queries older than QueryTimeout
+func (p *PPCC) checkTimeouts(now time.Time) error {
+    expired := make(map[*pendingQuery]bool)
+    for _, q := range p.pending {
+        if now.Sub(q.sentAt) >= p.QueryTimeout {
+            expired[q] = true
+        }
+    }
+
+    for q := range expired {
+        if q.attempts <= p.MaxRetries {
+            log.Lvl2("Query", q.id, "timed out, retrying")
+            p.sendQuery(q)
+            continue
+        }
+        p.settle(q)
+        p.giveUp(q, fmt.Sprintf("timed out after %d attempts", q.attempts))
+    }
+
+    if len(expired) == 0 {
+        return nil
+    }
+    return p.advance()
+}
+
+// handleReject gives up on a query its telecom refused.  A reject that is
+// not from that telecom, or not signed with a key it published, is dropped,
+// and the query left to time out.
+func (p *PPCC) handleReject(from *onet.TreeNode, in *Reject) error {
+    if !p.IsRoot() {
+        return fmt.Errorf("non-root received reject")
+    }
+
+    q, ok := p.pending[in.ID]
+    if !ok {
+        log.Lvl2("Ignoring reject of settled query", in.ID)
+        return nil
+    }
+    if err := p.checkSuite(in.Suite); err != nil {
+        return fmt.Errorf("dropping reject of query %d: %v", in.ID, err)
+    }
+    telecom := p.Telecoms[q.triple.Telecom]
+    if from == nil || from.ID != telecom.ID {
+        return fmt.Errorf("dropping reject of query %d not sent by telecom %d", in.ID, q.triple.Telecom)
+    }
+    if in.VerifyKey == nil || p.ppcc.VerifyMessage(in.signedFields(), in.VerifyKey, in.Signature) != nil {
+        return fmt.Errorf("dropping reject of query %d with an invalid signature", in.ID)
+    }
+    if err := checkSigner(telecom.ServerIdentity.Public, in.VerifyKey); err != nil {
+        return fmt.Errorf("dropping reject of query %d %v", in.ID, err)
+    }
+    p.settle(q)
+    p.audit(AuditQueryRejected, p.InitWarrant.ID, in.ID, in.Reason)
+    p.giveUp(q, "rejected: " + in.Reason)
+    return p.advance()
 }
 
 func (p *PPCC) handleReply(in *Reply) error {
@@ -233,62 +579,174 @@ func (p *PPCC) handleReply(in *Reply) error {
         return fmt.Errorf("non-root received reply")
     }
 
-    decryptedNode, _ := p.ppcc.DecryptTelecomMessage(in.EncQuery.K, in.EncQuery.C)
+    // Replies to queries that were retried or given up on are late duplicates
+    q, ok := p.pending[in.ID]
+    if !ok {
+        log.Lvl2("Ignoring reply to settled query", in.ID)
+        return nil
+    }
+    p.settle(q)
+    p.replyReceived(in.ID)
+    p.result.Replies++
+    if err := p.checkSuite(in.Suite); err != nil {
+        p.giveUp(q, err.Error())
+        return p.advance()
+    }
+    if err := p.checkReply(in); err != nil {
+        p.giveUp(q, "malformed reply: " + err.Error())
+        return p.advance()
+    }
+
+    // The telecom commits to its reply with a signing key it published
+    telecom := p.Telecoms[q.triple.Telecom].ServerIdentity.Public
+    if in.VerifyKey == nil || p.ppcc.VerifyMessage(in.signedFields(), in.VerifyKey, in.Signature) != nil {
+        p.giveUp(q, "invalid reply signature")
+        return p.advance()
+    }
+    if err := checkSigner(telecom, in.VerifyKey); err != nil {
+        p.giveUp(q, "reply " + err.Error())
+        return p.advance()
+    }
+
+    // A reply whose identifier or status does not decrypt is dropped, with
+    // the contacts it reveals
+    decryptedNode, err := p.ppcc.DecryptTelecomMessage(in.EncQuery)
+    var status string
+    if err == nil {
+        status, err = p.ppcc.DecryptTelecomMessage(in.EncStatus)
+    }
+    if err != nil {
+        p.decryptFailed()
+        p.giveUp(q, "could not decrypt reply: " + err.Error())
+        return p.advance()
+    }
     log.Lvl3("Decrypted node: ", decryptedNode)
-    p.OutputList[decryptedNode] = true
 
-    p.OutstandingPackets--
+    // The telecom withheld a protected node, or a target it does not hold
+    if decryptedNode == "" {
+        p.audit(AuditResultDecrypted, p.InitWarrant.ID, in.ID, "identifier withheld")
+        return p.advance()
+    }
+    p.audit(AuditResultDecrypted, p.InitWarrant.ID, in.ID, fmt.Sprintf("identifier %s, %d neighbors, %d calls",
+        decryptedNode, len(in.EncPhones), len(in.EncEdges)))
+    q.triple.ID = decryptedNode
+    if q.triple.Parent != nil {
+        p.ledger().Release(p.InitWarrant.ID, []string{decryptedNode}, -1)
+    }
+    contact := p.result.addContact(q.triple.Telecom, q.triple.Chain())
+    if status == statusExcluded {
+        log.Lvl2("Telecom", q.triple.Telecom, "excluded hub", decryptedNode)
+        contact.Excluded = true
+    }
+    if parent := q.triple.Parent; parent != nil {
+        p.result.addEdge(lib.NewPair(parent.ID, parent.Telecom), lib.NewPair(decryptedNode, q.triple.Telecom), q.triple.Weight)
+    }
+
+    // Calls to contacts revealed before
+    for i, encEdge := range in.EncEdges {
+        edge, err := p.ppcc.DecryptTelecomMessage(encEdge)
+        if err != nil {
+            log.Error("could not decrypt edge:", err)
+            p.decryptFailed()
+            continue
+        }
+        p.result.addEdge(lib.NewPair(decryptedNode, q.triple.Telecom), lib.NewPair(edge, in.EdgeTelecoms[i]), in.EdgeWeights[i])
+    }
+
+    if in.Truncated {
+        p.result.Truncated++
+    }
+    if in.Exhausted {
+        log.Lvl2("Telecom", q.triple.Telecom, "exhausted the budget of warrant", p.InitWarrant.ID)
+        p.result.Exhausted = true
+    }
+
+    warrant := p.InitWarrant
+    accepted := 0
     for i, s := range(in.Telecoms) {
         if s == "" {
             continue
         }
 
+        // Enforce the budget on the agency side, too
+        if warrant.MaxFanout > 0 && accepted >= warrant.MaxFanout {
+            p.result.Truncated++
+            break
+        }
+        if warrant.MaxContacts > 0 && p.revealed >= warrant.MaxContacts {
+            p.result.Exhausted = true
+            break
+        }
+        accepted++
+        p.revealed++
+
         // Decrypt message and telecom information
         telecom, _ := strconv.Atoi(in.Telecoms[i])
-        message := lib.Ciphertext{in.EncPhones[2 * i], in.EncPhones[2 * i + 1]}
+        message := in.EncPhones[i]
 
-        // Push to queue
-        triple := lib.NewTriple(message, telecom, p.CurrentDepth - 1)
+        // Push to queue, one hop further than the query this reply answers
+        triple := lib.NewTriple(message, telecom, in.Depth - 1)
+        triple.Parent = q.triple
+        triple.Weight = in.Weights[i]
+        if len(in.Releases) > 0 {
+            triple.Release = in.Releases[i]
+            triple.ReleaseKey = in.VerifyKey
+        }
         p.Queue.Push(triple)
     }
 
-    // See if the protocol has terminated
-    if p.OutstandingPackets == 0 && p.Queue.IsEmpty() {
-        p.NodeDone = true
-        return nil
-    }
+    // Dequeue and send next triple, or terminate
+    return p.advance()
+}
 
-    // Dequeue and send next triple 
-    if !p.Queue.IsEmpty() {
-        warrant := p.Queue.Pop()
-        telecomIdx := warrant.Telecom
-        if telecomIdx >= p.NumTelecoms {
-            return fmt.Errorf("invalid telecom number")
+// checkReply verifies that the lists of a reply are of the same length, and
+// that the telecoms they name exist
+func (p *PPCC) checkReply(in *Reply) error {
+    if len(in.Telecoms) != len(in.EncPhones) || len(in.Weights) != len(in.EncPhones) {
+        return fmt.Errorf("%d neighbors with %d telecoms and %d weights", len(in.EncPhones), len(in.Telecoms), len(in.Weights))
+    }
+    if len(in.Releases) > 0 && len(in.Releases) != len(in.EncPhones) {
+        return fmt.Errorf("%d neighbors with %d releases", len(in.EncPhones), len(in.Releases))
+    }
+    if len(in.EdgeTelecoms) != len(in.EncEdges) || len(in.EdgeWeights) != len(in.EncEdges) {
+        return fmt.Errorf("%d calls with %d telecoms and %d weights", len(in.EncEdges), len(in.EdgeTelecoms), len(in.EdgeWeights))
+    }
+    for _, s := range in.Telecoms {
+        if s == "" {
+            continue
         }
-        p.CurrentDepth = warrant.Depth
-
-        // Construct packet without signature
-        out := &AuthorityQuery {
-            EncQuery:   lib.Ciphertext{warrant.EncPhone.K, warrant.EncPhone.C},
-            Telecom:    warrant.Telecom,
-            Depth:      warrant.Depth,
+        if telecom, err := strconv.Atoi(s); err != nil || telecom < 0 || telecom >= p.NumTelecoms {
+            return fmt.Errorf("invalid telecom %q", s)
         }
-
-        // Sign the fields of the message and attach the signature to the packet
-        str := fmt.Sprintf("%+v%+v%+v", out.EncQuery, out.Telecom, out.Depth)
-        out.Signature = p.ppcc.SignMessage(str)
-        out.VerifyKey = p.ppcc.VerifyKey
-
-        err := p.SendTo(p.Telecoms[telecomIdx], out)
-        p.OutstandingPackets++
-        if err != nil {
-            log.Error("failed to send warant", err)
+    }
+    for _, telecom := range in.EdgeTelecoms {
+        if telecom < 0 || telecom >= p.NumTelecoms {
+            return fmt.Errorf("invalid telecom %d", telecom)
         }
     }
-
     return nil
 }
 
+// signedFields is the string a telecom signs for a Reply
+func (r *Reply) signedFields() string {
+    return fmt.Sprintf("%+v%+v%+v%+v%+v%+v%x%+v%+v%+v%+v%+v%+v%q", r.ID, r.EncQuery, r.EncStatus, r.EncPhones,
+        r.Telecoms, r.Weights, r.Releases, r.Depth, r.Truncated, r.Exhausted, r.EncEdges, r.EdgeTelecoms, r.EdgeWeights,
+        r.Suite)
+}
+
+// signedFields is the string a telecom signs for a Reject
+func (r *Reject) signedFields() string {
+    return fmt.Sprintf("%+v%q%q", r.ID, r.Reason, r.Suite)
+}
+
+// signedFields is the string the agency signs for an AuthorityQuery
+func (q *AuthorityQuery) signedFields() string {
+    return fmt.Sprintf("%+v%+v%+v%+v%+v%+v%+v%+v%+v%+v%+v%x%x%q%+v%x%+v%q%+v%+v%x%+v%x%+v%+v%+v%q", q.ID, q.EncQuery,
+        q.Telecom, q.Depth, q.Kinds, q.Subgraph, q.WarrantID, q.MaxContacts, q.MaxFanout, q.Remaining, q.WarrantDepth,
+        q.TargetCommitment, q.TargetSalt, q.Issuer, q.Issued, q.IssuerSignature, q.Expires, q.SessionID, q.Seq,
+        q.LogIndex, q.LogProof, q.TreeHead, q.Release, q.ReleaseKey, q.ReleaseDepth, q.ReleasedBy, q.Suite)
+}
+
 func (p *PPCC) handleAuthorityQuery (in *AuthorityQuery) error {
     var err error
 
@@ -296,60 +754,272 @@ func (p *PPCC) handleAuthorityQuery (in *AuthorityQuery) error {
         log.Lvl1("ERROR: Root received AuthorityQuery")
         return nil
     }
+    p.queryReceived = time.Now()
+    p.audit(AuditQueryReceived, in.WarrantID, in.ID, fmt.Sprintf("telecom %d depth %d session %s seq %d",
+        in.Telecom, in.Depth, in.SessionID, in.Seq))
 
     if p.TelecomIdx != in.Telecom {
         log.Lvl1("ERROR: Node ", p.TelecomIdx, " received msg intended for ", in.Telecom)
-        return nil
+        return p.reject(in, fmt.Sprintf("query for telecom %d sent to telecom %d", in.Telecom, p.TelecomIdx))
+    }
+    if err := p.checkSuite(in.Suite); err != nil {
+        return p.reject(in, err.Error())
     }
 
     // Verify the authorities' signature
     p.verifyKey = in.VerifyKey
-    str := fmt.Sprintf("%+v%+v%+v", in.EncQuery, in.Telecom, in.Depth)
-    verify := p.ppcc.VerifyMessage(str, p.verifyKey, in.Signature)
+    verify := p.ppcc.VerifyMessage(in.signedFields(), p.verifyKey, in.Signature)
     if verify != nil {
         log.Lvl1("ERROR: Could not verify signature: ", verify)
+        return p.reject(in, "invalid signature")
     }
 
-    // Decrypt the message and reencrypt it under the agency's public key
-    nodeQuery, _ := p.ppcc.DecryptTelecomMessage(in.EncQuery.K, in.EncQuery.C)
-    log.Lvl3("Node ", p.TelecomIdx, " handling query for ", nodeQuery)
-    K, C, _ := p.ppcc.EncryptTelecomMessage(nodeQuery, 0)
-    encQuery := lib.Ciphertext{K, C}
+    // An agency that published its keys signs with one of them
+    if checkSigner(p.Agency.ServerIdentity.Public, in.VerifyKey) != nil {
+        return p.reject(in, "query not signed with a published key of the agency")
+    }
+
+    // Releases are counted per warrant
+    if in.WarrantID == "" {
+        return p.reject(in, "missing warrant ID")
+    }
+
+    // Only warrants published in the transparency log are executed
+    if err := p.checkWarrantLogged(in); err != nil {
+        log.Lvl2("Telecom", p.TelecomIdx, "rejects unlogged warrant", in.WarrantID, ":", err)
+        return p.reject(in, "warrant not in transparency log: " + err.Error())
+    }
 
-    // Prepare to iterate over neighbors
-    query := lib.AgencyPair{nodeQuery, p.TelecomIdx}
+    // Replayed queries and queries for expired warrants are not answered
+    if err := p.checkFresh(in); err != nil {
+        log.Lvl2("Telecom", p.TelecomIdx, "rejects query", in.ID, ":", err)
+        return p.reject(in, err.Error())
+    }
+
+    // A retried query gets the reply sent before: the neighbors it released
+    // are visited now, and would not be released again
+    answerKey := fmt.Sprintf("%s/%s/%d", in.WarrantID, in.SessionID, in.ID)
+    if reply, ok := p.answered[answerKey]; ok {
+        p.audit(AuditQueryAnswered, in.WarrantID, in.ID, "reply resent")
+        return p.sendReply(in, reply, nil)
+    }
+
+    // Decrypt the message and reencrypt it under the agency's public key.  A
+    // protected node is replaced by the empty identifier and not expanded,
+    // and so is a target this telecom does not hold, so that the agency
+    // cannot tell the protected targets from the unknown ones.  A message
+    // that does not decrypt is rejected, except in hardened mode, where it is
+    // looked up as the empty identifier, found nowhere, and echoed like any
+    // other.  Such a message is not checked against the warrant's target
+    // either, so that it gets the reply of an unknown target.
+    p.measure.queries++
+    nodeQuery, err := p.ppcc.DecryptTelecomMessage(in.EncQuery)
+    decrypted := err == nil
+    if err != nil {
+        p.decryptFailed()
+        if hardenedBudget == 0 {
+            return p.reject(in, "could not decrypt query: " + err.Error())
+        }
+        nodeQuery = ""
+    }
+    if err := p.checkTarget(in, nodeQuery); decrypted && err != nil {
+        log.Lvl2("Telecom", p.TelecomIdx, "rejects query", in.ID, ":", err)
+        return p.reject(in, err.Error())
+    }
+    log.Lvl3("Node ", p.TelecomIdx, " handling query for ", nodeQuery)
+    query := lib.NewPair(nodeQuery, p.TelecomIdx)
     graph := p.LocalSubgraph
-    encPhones := make([]abstract.Point, 0)
-    telecoms  := make([]string, 0)
+    isProtected := graph != nil && graph.IsProtected(query)
+    if isProtected {
+        p.suppress()
+    }
+    isTarget := in.Release == nil && in.Depth == in.WarrantDepth
+    withheld := isProtected || (isTarget && (graph == nil || !graph.ContainsNode(query)))
+    var encQuery lib.Ciphertext
+    if hardenedBudget > 0 && !withheld {
+        // A message for a key this telecom does not hold is withheld
+        encQuery, err = p.ppcc.ReencryptTelecomMessage(in.EncQuery, 0)
+        withheld = err != nil
+    }
+    if hardenedBudget == 0 || withheld {
+        disclosed := nodeQuery
+        if withheld {
+            disclosed = ""
+        }
+        encQuery, err = p.ppcc.EncryptTelecomMessage(disclosed, 0)
+        if err != nil {
+            return p.reject(in, "could not encrypt query for agency: " + err.Error())
+        }
+    }
+
+    // Hubs are returned without their neighbors.  Every reply carries an
+    // encrypted status, so the agency alone learns which nodes are hubs.
+    status := statusOK
+    if !withheld && graph != nil && graph.IsHub(query) {
+        log.Lvl2("Telecom", p.TelecomIdx, "excluding hub from query", in.ID)
+        status = statusExcluded
+    }
+    encStatus, err := p.ppcc.EncryptTelecomMessage(status, 0)
+    if err != nil {
+        return p.reject(in, "could not encrypt status: " + err.Error())
+    }
+    revealed := []string{}
+    reply := &Reply{
+        ID:         in.ID,
+        EncQuery:   encQuery,
+        EncStatus:  encStatus,
+        EncPhones:  make([]lib.Ciphertext, 0),
+        Telecoms:   make([]string, 0),
+        Weights:    make([]int, 0),
+        Depth:      in.Depth,
+        Suite:      p.Suite().String(),
+    }
 
     // Iterate over neighbors of the node, and create encrypted sets to send back to agency
-    if in.Depth > 0 && graph.ContainsNode(query) {
-        neighbors := graph.Neighbors(query)
-        for _, edge := range neighbors {
+    if graph != nil && graph.ContainsNode(query) && status != statusExcluded && !isProtected {
+        var unvisited []lib.Edge
+        seen := make(map[lib.AgencyPair]bool)
+        if in.Depth > 0 {
+            for _, edge := range graph.Neighbors(query) {
+                pair := edge.Pair
+                if !lib.KindAllowed(in.Kinds, pair.Kind) || graph.HasVisited(pair) || seen[pair] {
+                    continue
+                }
+                seen[pair] = true
+                if graph.IsProtected(pair) {
+                    p.suppress()
+                    continue
+                }
+                unvisited = append(unvisited, edge)
+            }
+        }
+
+        // Release no more than the fan-out limit, what the agency has left
+        // of the warrant's budget, and what this telecom has left of it
+        // allow.  Every neighbor is encrypted before any is counted as
+        // released, so that a failure releases none.
+        n := len(unvisited)
+        if in.MaxFanout > 0 && n > in.MaxFanout {
+            n = in.MaxFanout
+            reply.Truncated = true
+        }
+        if in.MaxContacts > 0 && n > in.Remaining {
+            n = in.Remaining
+            if n < 0 {
+                n = 0
+            }
+            reply.Exhausted = true
+        }
+        encPhones := make([]lib.Ciphertext, n)
+        ids := make([]string, n)
+        for i, edge := range unvisited[:n] {
+            ids[i] = edge.Pair.ID()
+            encPhones[i], err = p.ppcc.EncryptTelecomMessage(ids[i], numAuthorities + edge.Pair.Telecom)
+            if err != nil {
+                return p.reject(in, "could not encrypt neighbor: " + err.Error())
+            }
+        }
+        granted := p.ledger().Release(in.WarrantID, ids, releaseLimit(in.MaxContacts))
+        if granted < n {
+            log.Lvl2("Telecom", p.TelecomIdx, "exhausted the budget of warrant", in.WarrantID)
+            reply.Exhausted = true
+        }
+
+        for i, edge := range unvisited[:granted] {
             pair := edge.Pair
-            if !graph.HasVisited(pair) {
-                K, C, _ = p.ppcc.EncryptTelecomMessage(pair.Node, numAuthorities + pair.Telecom)
-                encPhones = append(encPhones, []abstract.Point{K, C}...)
-                telecoms  = append(telecoms, strconv.Itoa(pair.Telecom))
-                graph.MarkVisited(pair)
+            reply.EncPhones = append(reply.EncPhones, encPhones[i])
+            reply.Telecoms  = append(reply.Telecoms, strconv.Itoa(pair.Telecom))
+            reply.Weights   = append(reply.Weights, edge.Weight)
+            if release := p.release(in, pair.Telecom, encPhones[i]); release != nil {
+                reply.Releases = append(reply.Releases, release)
             }
+            graph.MarkVisited(pair)
+            revealed = append(revealed, pair.ID())
         }
-        log.Lvl3("Found ", len(telecoms), " unvisited neighbors: ")
+
+        for _, edge := range graph.Neighbors(query) {
+            pair := edge.Pair
+            if !lib.KindAllowed(in.Kinds, pair.Kind) {
+                continue
+            }
+
+            // Neighbors this telecom released under the warrant in earlier
+            // replies are already known to the agency, so the call to them
+            // is, too
+            if in.Subgraph && p.ledger().IsReleased(in.WarrantID, pair.ID()) && !seen[pair] && !graph.IsProtected(pair) {
+                encEdge, err := p.ppcc.EncryptTelecomMessage(pair.ID(), 0)
+                if err != nil {
+                    return p.reject(in, "could not encrypt edge: " + err.Error())
+                }
+                reply.EncEdges     = append(reply.EncEdges, encEdge)
+                reply.EdgeTelecoms = append(reply.EdgeTelecoms, pair.Telecom)
+                reply.EdgeWeights  = append(reply.EdgeWeights, edge.Weight)
+            }
+        }
+        log.Lvl3("Found ", len(reply.Telecoms), " unvisited neighbors: ")
     }
 
-    // Send original query (encrypted with agency pubkey) and neighbors (under telecom pubkeys)
-    err = p.SendTo(p.Agency, &Reply{encQuery, encPhones, telecoms})
-    if err != nil {
-        log.Lvl1("ERROR while sending to agency:", err)
-        return err
+    // The audit record names what is released, and only that
+    disclosed := nodeQuery
+    if isProtected {
+        disclosed = "(protected)"
+    } else if withheld {
+        disclosed = "(withheld)"
     }
-    return nil
+    p.audit(AuditQueryAnswered, in.WarrantID, in.ID, fmt.Sprintf("identifier %s status %s released %v calls %d truncated %v exhausted %v",
+        disclosed, status, revealed, len(reply.EncEdges), reply.Truncated, reply.Exhausted))
+    reply.Signature = p.ppcc.SignMessage(reply.signedFields())
+    reply.VerifyKey = p.ppcc.VerifyKey
+    p.answered[answerKey] = reply
+    return p.sendReply(in, reply, revealed)
 }
 
-func (p *PPCC) handleDone (in *Done) error {
+// sendReply sends the original query (encrypted with agency pubkey) and
+// neighbors (under telecom pubkeys) to the agency.  The auditor also gets
+// the contacts released, unless the reply is sent again.
+func (p *PPCC) sendReply(in *AuthorityQuery, reply *Reply, released []string) error {
+    return p.afterBudget(func() error {
+        p.sendTranscript(in.WarrantID, reply)
+        if released != nil {
+            record := &Released{ID: in.ID}
+            for _, id := range released {
+                record.Contacts = append(record.Contacts, releaseHash(in.WarrantID, id))
+            }
+            p.sendTranscript(in.WarrantID, record)
+        }
+        err := p.sendTo(p.Agency, reply)
+        if err != nil {
+            log.Lvl1("ERROR while sending to agency:", err)
+            return err
+        }
+        return nil
+    })
+}
+
+// reject refuses to answer a query
+func (p *PPCC) reject(in *AuthorityQuery, reason string) error {
+    p.audit(AuditQueryRejected, in.WarrantID, in.ID, reason)
+    reject := &Reject{ID: in.ID, Reason: reason, Suite: p.Suite().String()}
+    reject.Signature = p.ppcc.SignMessage(reject.signedFields())
+    reject.VerifyKey = p.ppcc.VerifyKey
+    return p.afterBudget(func() error {
+        p.sendTranscript(in.WarrantID, reject)
+        return p.sendTo(p.Agency, reject)
+    })
+}
+
+func (p *PPCC) handleDone (from *onet.TreeNode, in *Done) error {
     if p.IsRoot() {
         return fmt.Errorf("root received done message")
     }
+    if err := p.checkSuite(in.Suite); err != nil {
+        return err
+    }
+
+    // The auditor waits for the transcripts still underway
+    if p.IsAuditor {
+        return p.handleAuditDone(from, in)
+    }
 
     p.NodeDone = true
     return nil
@@ -1,17 +1,1328 @@
 package protocol
 
 import (
-	//"fmt"
-	//"github.com/hm16083/ppcc/lib"
-	//"github.com/hm16083/ppcc/protocol"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
-	//"time"
+	"time"
 
-	//"gopkg.in/dedis/onet.v1"
-	//"gopkg.in/dedis/onet.v1/log"
-	//"gopkg.in/dedis/onet.v1/network"
+	"github.com/hm16083/ppcc/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 )
 
-func TestNode(t *testing.T) {
-    println("ppcc_test not implemented")
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// protocolTimeout bounds a single protocol run in the tests
+var protocolTimeout = 30 * time.Second
+
+// protocolName is the protocol startWarrant runs.  Under "PPCCTamper", every
+// node passes the messages it sends to tamper, which may alter them, and
+// drops those for which tamper returns false.
+var protocolName = "PPCC"
+var tamper func(msg interface{}) bool
+
+func init() {
+	onet.GlobalProtocolRegister("PPCCTamper", func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		pi, err := NewPPCC(n)
+		if err != nil {
+			return nil, err
+		}
+		p := pi.(*PPCC)
+		send := p.send
+		p.send = func(tn *onet.TreeNode, msg interface{}) error {
+			if tamper != nil && !tamper(msg) {
+				return nil
+			}
+			return send(tn, msg)
+		}
+		return p, nil
+	})
+}
+
+// tampered runs f with tamper set on the messages of the protocol
+func tampered(hook func(msg interface{}) bool, f func()) {
+	protocolName, tamper = "PPCCTamper", hook
+	defer func() {
+		protocolName, tamper = "PPCC", nil
+	}()
+	f()
+}
+
+// readGraphs reads the graphs used by the simulation
+func readGraphs() []*lib.TelecomGraph {
+	var graphs []*lib.TelecomGraph
+	for _, file := range []string{"../simulation/graph0.tgf", "../simulation/graph1.tgf", "../simulation/graph2.tgf"} {
+		graph, err := lib.ReadGraph(file)
+		if err != nil {
+			panic("ERROR: could not read graph: " + err.Error())
+		}
+		graphs = append(graphs, graph)
+	}
+	return graphs
+}
+
+// runWarrant executes a warrant on a local network of an agency and the
+// given number of telecoms, and returns the agency and its result once it
+// completed
+func runWarrant(graphs []*lib.TelecomGraph, numTelecoms int, warrant Warrant) (*PPCC, *Result) {
+	rh, result := startWarrant(graphs, numTelecoms, warrant, nil)
+	if !result.Complete {
+		panic(fmt.Sprintf("ERROR: protocol incomplete: %v %+v", result.Err, result.Unanswered))
+	}
+	return rh, result
+}
+
+// startWarrant executes a warrant like runWarrant; setup is called on the
+// network and the agency before the protocol starts
+func startWarrant(graphs []*lib.TelecomGraph, numTelecoms int, warrant Warrant,
+	setup func(*onet.LocalTest, *onet.Tree, *PPCC)) (*PPCC, *Result) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+
+	graphArr := make([]lib.TelecomGraph, len(graphs))
+	for i, graph := range graphs {
+		graph.ResetVisited()
+		graphArr[i] = *graph
+	}
+	SetGraphs(graphArr)
+
+	numNodes := numTelecoms + numAuthorities
+	if auditorEnabled {
+		numNodes++
+	}
+	_, _, tree := local.GenTree(numNodes, true)
+	p, err := local.CreateProtocol(protocolName, tree)
+	if err != nil {
+		panic("ERROR: could not create protocol: " + err.Error())
+	}
+
+	// Warrants the tests did not give an ID are issued with a fresh one, and
+	// warrants not issued through a transparency log with an expiry
+	if warrant.ID == "" {
+		warrant.ID = randomID()
+	}
+	if warrant.Expires == 0 && warrant.Signature == nil {
+		warrant.Expires = time.Now().Add(time.Hour).UnixNano()
+	}
+	rh := p.(*PPCC)
+	rh.InitWarrant = warrant
+	if setup != nil {
+		setup(local, tree, rh)
+	}
+	go rh.Start()
+
+	select {
+	case result := <-rh.ProtocolDone:
+		return rh, result
+	case <-time.After(protocolTimeout):
+		panic("ERROR: protocol did not terminate")
+	}
+}
+
+// checkWarrant runs a warrant and compares its output with the reference
+func checkWarrant(graphs []*lib.TelecomGraph, numTelecoms int, warrant Warrant) *Result {
+	rh, result := runWarrant(graphs, numTelecoms, warrant)
+	expected := lib.ReferenceChain(graphs, lib.NewPair(warrant.Phone, warrant.Telecom),
+		warrant.Depth, warrant.Kinds)
+	if err := lib.CheckOutput(expected, result.IDs()); err != nil {
+		panic("ERROR: wrong output: " + err.Error())
+	}
+	if rh.OutstandingPackets != 0 || !rh.Queue.IsEmpty() {
+		panic("ERROR: protocol terminated with pending queries")
+	}
+	return result
+}
+
+func TestDepths(t *testing.T) {
+	graphs := readGraphs()
+	for depth := 0; depth <= 4; depth++ {
+		checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: depth})
+	}
+
+	// Start from a number of another carrier
+	checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567899", Telecom: 2, Depth: 2})
+
+	println("PASS: Protocol depth test")
+}
+
+// targetReply runs a warrant and returns what the agency learns from the
+// reply on the target
+func targetReply(graphs []*lib.TelecomGraph, warrant Warrant) string {
+	var mu sync.Mutex
+	var reply *Reply
+	var rh *PPCC
+	var result *Result
+	tampered(func(msg interface{}) bool {
+		if r, ok := msg.(*Reply); ok && r.ID == 1 {
+			mu.Lock()
+			reply = r
+			mu.Unlock()
+		}
+		return true
+	}, func() {
+		rh, result = runWarrant(graphs, len(graphs), warrant)
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if reply == nil {
+		panic("ERROR: target not answered")
+	}
+	id, err := rh.ppcc.DecryptTelecomMessage(reply.EncQuery)
+	if err != nil {
+		panic("ERROR: could not decrypt target: " + err.Error())
+	}
+	status, err := rh.ppcc.DecryptTelecomMessage(reply.EncStatus)
+	if err != nil {
+		panic("ERROR: could not decrypt status: " + err.Error())
+	}
+	return fmt.Sprintf("identifier %q status %s neighbors %d calls %d truncated %v exhausted %v contacts %d",
+		id, status, len(reply.EncPhones), len(reply.EncEdges), reply.Truncated, reply.Exhausted, len(result.Contacts))
+}
+
+func TestUnknownTarget(t *testing.T) {
+	graphs := readGraphs()
+	_, result := runWarrant(graphs, len(graphs), Warrant{Phone: "5550000000", Telecom: 1, Depth: 3})
+	if len(result.Contacts) != 0 {
+		panic("ERROR: unknown target revealed contacts")
+	}
+
+	// An unknown target is withheld like a protected one
+	unknown := targetReply(graphs, Warrant{Phone: "5550000000", Telecom: 2, Depth: 2})
+	graphs[2].Protect([]string{"1234567899"})
+	if protected := targetReply(graphs, Warrant{Phone: "1234567899", Telecom: 2, Depth: 2}); protected != unknown {
+		panic(fmt.Sprintf("ERROR: unknown target answered with %q, protected one with %q", unknown, protected))
+	}
+
+	println("PASS: Protocol unknown target test")
+}
+
+func TestKindRestriction(t *testing.T) {
+	// Both carriers hold the whole graph of mixed identifiers
+	var graphs []*lib.TelecomGraph
+	for i := 0; i < 2; i++ {
+		graph, err := lib.ReadGraph("../lib/tgf_identifiers.tgf")
+		if err != nil {
+			panic("ERROR: could not read graph: " + err.Error())
+		}
+		graphs = append(graphs, graph)
+	}
+	checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 2})
+	checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 2,
+		Kinds: []lib.IDKind{lib.KindPhone, lib.KindIMSI}})
+
+	println("PASS: Protocol kind restriction test")
+}
+
+func TestMoreServersThanGraphs(t *testing.T) {
+	graphs := readGraphs()
+	checkWarrant(graphs, len(graphs)+2, Warrant{Phone: "1234567890", Telecom: 0, Depth: 3})
+
+	println("PASS: Protocol truncation test")
+}
+
+func TestGeneratedGraphs(t *testing.T) {
+	graphs, err := lib.GenerateGraphs(lib.GeneratorConfig{
+		Nodes:                300,
+		Carriers:             4,
+		AvgDegree:            3,
+		CommunityFraction:    0.8,
+		CrossCarrierFraction: 0.3,
+		Seed:                 7,
+	})
+	if err != nil {
+		panic("ERROR: could not generate graphs: " + err.Error())
+	}
+
+	// Target the busiest subscriber of the first carrier
+	target, degree := lib.AgencyPair{}, -1
+	for node := range graphs[0].Nodes {
+		if node.Telecom == 0 && len(graphs[0].Neighbors(node)) > degree {
+			target, degree = node, len(graphs[0].Neighbors(node))
+		}
+	}
+	checkWarrant(graphs, len(graphs), Warrant{Phone: target.ID(), Telecom: 0, Depth: 2})
+
+	println("PASS: Protocol generated graph test")
+}
+
+func TestUnresponsiveTelecom(t *testing.T) {
+	graphs := readGraphs()
+
+	// Telecom 1 crashes before the protocol starts
+	rh, result := startWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 4},
+		func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			rh.QueryTimeout = 200 * time.Millisecond
+			rh.MaxRetries = 1
+			local.Servers[tree.List()[numAuthorities+1].ServerIdentity.ID].Close()
+		})
+
+	if result.Complete || result.Err != nil || len(result.Unanswered) == 0 {
+		panic("ERROR: unanswered queries not reported")
+	}
+	for _, q := range result.Unanswered {
+		if q.Telecom != 1 || q.Attempts != 2 {
+			panic(fmt.Sprintf("ERROR: wrong unanswered query %+v", q))
+		}
+	}
+	if rh.OutstandingPackets != 0 || !rh.Queue.IsEmpty() {
+		panic("ERROR: protocol terminated with pending queries")
+	}
+
+	// The contacts held by the other telecoms are still found
+	if !result.IDs()["1234567890"] {
+		panic("ERROR: target missing from output")
+	}
+
+	println("PASS: Protocol unresponsive telecom test")
+}
+
+func TestLostReply(t *testing.T) {
+	graphs := readGraphs()
+	warrant := Warrant{Phone: "1234567890", Telecom: 0, Depth: 3}
+
+	// The reply to the target, which releases its neighbors, is lost; the
+	// retry gets the same reply
+	var mutex sync.Mutex
+	dropped := false
+	var result *Result
+	tampered(func(msg interface{}) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if _, ok := msg.(*Reply); ok && !dropped {
+			dropped = true
+			return false
+		}
+		return true
+	}, func() {
+		_, result = startWarrant(graphs, len(graphs), warrant,
+			func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+				rh.QueryTimeout = 200 * time.Millisecond
+			})
+	})
+
+	if !dropped || !result.Complete || result.Queries != result.Replies+1 {
+		panic(fmt.Sprintf("ERROR: lost reply not retried: %d queries %d replies", result.Queries, result.Replies))
+	}
+	expected := lib.ReferenceChain(graphs, lib.NewPair(warrant.Phone, warrant.Telecom), warrant.Depth, warrant.Kinds)
+	if err := lib.CheckOutput(expected, result.IDs()); err != nil {
+		panic("ERROR: contacts lost with the reply: " + err.Error())
+	}
+
+	println("PASS: Protocol lost reply test")
+}
+
+func TestInvalidWarrant(t *testing.T) {
+	graphs := readGraphs()
+	_, result := startWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 5, Depth: 1}, nil)
+	if result.Complete || result.Err == nil {
+		panic("ERROR: invalid warrant not reported")
+	}
+
+	println("PASS: Protocol invalid warrant test")
+}
+
+func TestResult(t *testing.T) {
+	graphs := readGraphs()
+	warrant := Warrant{Phone: "1234567890", Telecom: 0, Depth: 4}
+	result := checkWarrant(graphs, len(graphs), warrant)
+
+	target := result.Contacts[0]
+	if target.ID != warrant.Phone || target.Hops != 0 || target.Telecom != 0 || len(target.Via) != 0 {
+		panic(fmt.Sprintf("ERROR: wrong target contact %+v", target))
+	}
+	if result.Queries < len(result.Contacts) || result.Replies != result.Queries || result.Duration <= 0 {
+		panic(fmt.Sprintf("ERROR: wrong counts %d queries %d replies", result.Queries, result.Replies))
+	}
+
+	// Every contact is reached by a chain of calls of its hop length
+	for i, c := range result.Contacts {
+		if i > 0 && c.Hops < result.Contacts[i-1].Hops {
+			panic("ERROR: contacts not sorted by hops")
+		}
+		path := c.Chain
+		if len(path) != c.Hops+1 || path[0] != warrant.Phone || path[c.Hops] != c.ID {
+			panic(fmt.Sprintf("ERROR: wrong path %v to %+v", path, c))
+		}
+		for j := 1; j < len(path); j++ {
+			from, _ := result.Contact(path[j-1])
+			to, _ := result.Contact(path[j])
+			if !graphs[from.Telecom].ContainsEdge(lib.NewPair(from.ID, from.Telecom), lib.NewPair(to.ID, to.Telecom)) {
+				panic(fmt.Sprintf("ERROR: path %v uses a missing edge", path))
+			}
+		}
+	}
+
+	println("PASS: Protocol result test")
+}
+
+func TestProvenance(t *testing.T) {
+	graphs := readGraphs()
+	result := checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 3})
+
+	// Every call of the provenance graph is a call of the carrier graphs,
+	// and every contact but the target was reached by one
+	prov := result.Provenance()
+	if prov.NumNodes != len(result.Contacts) {
+		panic("ERROR: provenance graph misses contacts")
+	}
+	for _, c := range result.Contacts {
+		node := lib.NewPair(c.ID, c.Telecom)
+		if c.Hops > 0 && len(prov.Neighbors(node)) == 0 {
+			panic("ERROR: contact without provenance: " + c.ID)
+		}
+		for _, edge := range prov.Neighbors(node) {
+			if !graphs[c.Telecom].ContainsEdge(node, edge.Pair) && !graphs[edge.Pair.Telecom].ContainsEdge(edge.Pair, node) {
+				panic("ERROR: provenance edge not in graphs: " + c.ID + " " + edge.Pair.ID())
+			}
+		}
+	}
+
+	// The provenance graph can be exported
+	file, err := ioutil.TempFile("", "provenance")
+	if err != nil {
+		panic("ERROR: " + err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := lib.WriteGraphFormat(file.Name(), prov, lib.FormatGraphML); err != nil {
+		panic("ERROR: could not export provenance: " + err.Error())
+	}
+	read, err := lib.ReadGraphFormat(file.Name(), lib.FormatGraphML, nil)
+	if err != nil || read.NumNodes != prov.NumNodes {
+		panic("ERROR: could not read back provenance")
+	}
+
+	println("PASS: Protocol provenance test")
+}
+
+func TestSubgraph(t *testing.T) {
+	graphs, err := lib.GenerateGraphs(lib.GeneratorConfig{
+		Nodes:                200,
+		Carriers:             3,
+		AvgDegree:            4,
+		CommunityFraction:    0.8,
+		CrossCarrierFraction: 0.3,
+		Seed:                 11,
+	})
+	if err != nil {
+		panic("ERROR: could not generate graphs: " + err.Error())
+	}
+	warrant := Warrant{Phone: lib.GeneratedPhone(0), Depth: 2}
+	for i, graph := range graphs {
+		if graph.ContainsNode(lib.NewPair(warrant.Phone, i)) {
+			warrant.Telecom = i
+		}
+	}
+
+	if result := checkWarrant(graphs, len(graphs), warrant); result.Graph != nil {
+		panic("ERROR: subgraph returned without being asked for")
+	}
+
+	warrant.Subgraph = true
+	result := checkWarrant(graphs, len(graphs), warrant)
+	g := result.Graph
+	if g == nil || g.NumNodes != len(result.Contacts) {
+		panic("ERROR: subgraph misses contacts")
+	}
+
+	// The subgraph holds the calls of the provenance graph and only calls
+	// of the carrier graphs
+	prov := result.Provenance()
+	for node := range prov.Nodes {
+		for _, edge := range prov.Neighbors(node) {
+			if !g.ContainsEdge(node, edge.Pair) {
+				panic("ERROR: subgraph misses call " + node.ID() + " " + edge.Pair.ID())
+			}
+		}
+	}
+	for node := range g.Nodes {
+		for _, edge := range g.Neighbors(node) {
+			if !graphs[node.Telecom].ContainsEdge(node, edge.Pair) && !graphs[edge.Pair.Telecom].ContainsEdge(edge.Pair, node) {
+				panic("ERROR: subgraph call not in graphs: " + node.ID() + " " + edge.Pair.ID())
+			}
+		}
+	}
+
+	println("PASS: Protocol subgraph test")
+}
+
+func TestMalformedReply(t *testing.T) {
+	agency := &PPCC{NumTelecoms: 3}
+	ok := Reply{EncPhones: make([]lib.Ciphertext, 2), Telecoms: []string{"0", "2"}, Weights: []int{1, 1}}
+	if agency.checkReply(&ok) != nil {
+		panic("ERROR: valid reply refused")
+	}
+
+	// Lists of different lengths and unknown telecoms are refused
+	short, badTelecom, badEdge := ok, ok, ok
+	short.Weights = []int{1}
+	badTelecom.Telecoms = []string{"0", "3"}
+	badEdge.EncEdges = make([]lib.Ciphertext, 1)
+	badEdge.EdgeTelecoms = []int{-1}
+	badEdge.EdgeWeights = []int{1}
+	for _, r := range []Reply{short, badTelecom, badEdge} {
+		if agency.checkReply(&r) == nil {
+			panic(fmt.Sprintf("ERROR: malformed reply accepted: %+v", r))
+		}
+	}
+
+	println("PASS: Protocol malformed reply test")
+}
+
+func TestReplySignature(t *testing.T) {
+	graphs := readGraphs()
+	suite := network.Suite
+
+	// A reply altered on the way, or signed with a key the telecom did not
+	// publish, is not accepted
+	other := suite.Scalar().Pick(random.Stream)
+	for _, hook := range []func(r *Reply){
+		func(r *Reply) {
+			r.Truncated = true
+		},
+		func(r *Reply) {
+			r.VerifyKey = suite.Point().Mul(nil, other)
+			r.Signature = lib.SchnorrSign(suite, random.Stream, []byte(r.signedFields()), other)
+		},
+	} {
+		var result *Result
+		tampered(func(msg interface{}) bool {
+			if r, ok := msg.(*Reply); ok && r.ID == 1 {
+				hook(r)
+			}
+			return true
+		}, func() {
+			_, result = startWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 2}, nil)
+		})
+		if result.Complete || len(result.Contacts) != 0 || len(result.Unanswered) != 1 ||
+			!strings.Contains(result.Unanswered[0].Reason, "signature") && !strings.Contains(result.Unanswered[0].Reason, "published key") {
+			panic(fmt.Sprintf("ERROR: reply with wrong signature accepted: %+v", result.Unanswered))
+		}
+	}
+
+	// A reject altered on the way is dropped, and the query times out
+	// instead of being given up as rejected
+	var result *Result
+	tampered(func(msg interface{}) bool {
+		if r, ok := msg.(*Reject); ok {
+			r.Reason = "forged"
+		}
+		return true
+	}, func() {
+		expired := Warrant{Phone: "1234567890", Telecom: 0, Depth: 2, Expires: time.Now().Add(-time.Second).UnixNano()}
+		_, result = startWarrant(graphs, len(graphs), expired, func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			rh.QueryTimeout = 200 * time.Millisecond
+			rh.MaxRetries = 1
+		})
+	})
+	if result.Complete || len(result.Unanswered) != 1 || !strings.Contains(result.Unanswered[0].Reason, "timed out") {
+		panic(fmt.Sprintf("ERROR: forged reject accepted: %+v", result.Unanswered))
+	}
+
+	println("PASS: Protocol reply signature test")
+}
+
+func TestBudget(t *testing.T) {
+	graphs, err := lib.GenerateGraphs(lib.GeneratorConfig{
+		Nodes:     300,
+		Carriers:  3,
+		AvgDegree: 6,
+		Seed:      5,
+	})
+	if err != nil {
+		panic("ERROR: could not generate graphs: " + err.Error())
+	}
+
+	// Target the busiest subscriber of the first carrier
+	target, degree := lib.AgencyPair{}, -1
+	for node := range graphs[0].Nodes {
+		if node.Telecom == 0 && len(graphs[0].Neighbors(node)) > degree {
+			target, degree = node, len(graphs[0].Neighbors(node))
+		}
+	}
+	warrant := Warrant{ID: "budget-1", Phone: target.ID(), Telecom: 0, Depth: 3, MaxContacts: 20, MaxFanout: 3}
+	_, result := runWarrant(graphs, len(graphs), warrant)
+
+	if !result.Exhausted || result.Truncated == 0 || len(result.Contacts) > warrant.MaxContacts {
+		panic(fmt.Sprintf("ERROR: budget not enforced: %d contacts", len(result.Contacts)))
+	}
+	children := make(map[string]int)
+	for _, c := range result.Contacts {
+		if c.Hops > 0 {
+			children[c.Chain[c.Hops-1]]++
+		}
+	}
+	for id, n := range children {
+		if n > warrant.MaxFanout {
+			panic(fmt.Sprintf("ERROR: %s revealed %d contacts", id, n))
+		}
+	}
+
+	// The agency keeps what it learned under the warrant, so running it
+	// again reveals no contact beyond the budget, and every telecom keeps
+	// its own count
+	for i := range graphs {
+		if n := ledger(fmt.Sprintf("telecom%d", i)).Released(warrant.ID); n > releaseLimit(warrant.MaxContacts) {
+			panic(fmt.Sprintf("ERROR: telecom %d released %d contacts", i, n))
+		}
+	}
+	ids := result.IDs()
+	for run := 0; run < 3; run++ {
+		_, result = runWarrant(graphs, len(graphs), warrant)
+		for id := range result.IDs() {
+			ids[id] = true
+		}
+	}
+	if len(ids) > warrant.MaxContacts {
+		panic(fmt.Sprintf("ERROR: warrant budget renewed by running it again: %d contacts", len(ids)))
+	}
+
+	// A warrant without an ID is not run
+	_, result = startWarrant(graphs, len(graphs), Warrant{Phone: target.ID(), Telecom: 0, Depth: 1},
+		func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			rh.InitWarrant.ID = ""
+		})
+	if result.Complete || result.Err == nil {
+		panic("ERROR: warrant without an ID run")
+	}
+
+	// Another warrant has a budget of its own
+	warrant.ID = "budget-2"
+	_, result = runWarrant(graphs, len(graphs), warrant)
+	if len(result.Contacts) <= 1 {
+		panic("ERROR: warrants share a budget")
+	}
+
+	println("PASS: Protocol budget test")
+}
+
+func TestHubExclusion(t *testing.T) {
+	graphs := readGraphs()
+
+	// The target calls five numbers, so it is a hub above degree 4
+	graphs[0].HubDegree = 4
+	_, result := runWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 3})
+	if len(result.Contacts) != 1 || !result.Contacts[0].Excluded {
+		panic("ERROR: target hub chained through")
+	}
+
+	// Listed hubs are returned, but not chained through
+	graphs[0].HubDegree = 0
+	if graphs[1].ExcludeHubs([]string{"1234567896", "5550000000"}) != 1 {
+		panic("ERROR: wrong number of hubs found")
+	}
+	result = checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 4})
+	hubs := result.Hubs()
+	if len(hubs) != 1 || hubs[0] != "1234567896" || len(result.Contacts) != 7 {
+		panic(fmt.Sprintf("ERROR: wrong hubs %v in %d contacts", hubs, len(result.Contacts)))
+	}
+
+	println("PASS: Protocol hub exclusion test")
+}
+
+func TestProtected(t *testing.T) {
+	graphs := readGraphs()
+	before0, before1 := Suppressions(0), Suppressions(1)
+
+	// 1234567892 is protected by its own telecom, 1234567893 by the telecom
+	// revealing it; the contacts found through other numbers remain
+	graphs[1].Protect([]string{"1234567892"})
+	graphs[0].Protect([]string{"1234567893"})
+	result := checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 4, Subgraph: true})
+	ids := result.IDs()
+	if ids["1234567892"] || ids["1234567893"] || !ids["1234567896"] {
+		panic("ERROR: protected number disclosed")
+	}
+	for node := range result.Graph.Nodes {
+		if node.Node == "1234567892" || node.Node == "1234567893" {
+			panic("ERROR: protected number in subgraph")
+		}
+	}
+	if Suppressions(0) <= before0 || Suppressions(1) <= before1 {
+		panic("ERROR: suppressions not counted")
+	}
+
+	// A protected target is not disclosed either
+	before2 := Suppressions(2)
+	graphs[2].Protect([]string{"1234567899"})
+	_, result = runWarrant(graphs, len(graphs), Warrant{Phone: "1234567899", Telecom: 2, Depth: 2})
+	if len(result.Contacts) != 0 {
+		panic("ERROR: protected target disclosed")
+	}
+	if Suppressions(2) != before2+1 {
+		panic("ERROR: suppression of target not counted")
+	}
+
+	println("PASS: Protocol protected number test")
+}
+
+func TestAuditLogs(t *testing.T) {
+	graphs := readGraphs()
+	var nodes []*onet.TreeNode
+	rh, result := startWarrant(graphs, len(graphs), Warrant{ID: "audit-1", Phone: "1234567890", Telecom: 0, Depth: 4},
+		func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			nodes = tree.List()
+		})
+	if !result.Complete {
+		panic("ERROR: protocol incomplete")
+	}
+
+	// Every node keeps a verifiable log of the warrant
+	events := make(map[string]int)
+	for _, node := range nodes {
+		l := AuditLog(node.ServerIdentity.Public)
+		records := l.Records()
+		if l.Public.Equal(node.ServerIdentity.Public) {
+			panic("ERROR: audit log signed with the node's key")
+		}
+		key, ok := AuditKey(node.ServerIdentity.Public)
+		if !ok || !key.Equal(l.Public) {
+			panic("ERROR: audit key not published")
+		}
+		if err := lib.VerifyAuditRecords(rh.Suite(), key, records); err != nil {
+			panic("ERROR: audit log does not verify: " + err.Error())
+		}
+		for _, r := range records {
+			if r.Warrant != "audit-1" {
+				panic("ERROR: audit record of another warrant: " + r.Warrant)
+			}
+			events[r.Event]++
+		}
+	}
+
+	if events[AuditWarrant] != 1 || events[AuditDone] != 1 ||
+		events[AuditQuerySent] != result.Queries || events[AuditQueryReceived] != result.Queries ||
+		events[AuditQueryAnswered] != result.Replies || events[AuditResultDecrypted] != result.Replies {
+		panic(fmt.Sprintf("ERROR: wrong audit events %v", events))
+	}
+
+	// With an AuditDir, the keys signing the logs are kept encrypted, and
+	// their public halves next to the logs
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		panic("ERROR: could not create directory: " + err.Error())
+	}
+	defer os.RemoveAll(dir)
+	AuditDir = dir
+	defer func() { AuditDir = "" }()
+	if _, err := auditKey(rh.Suite(), "node", filepath.Join(dir, "node.audit.key")); err == nil {
+		panic("ERROR: audit key stored without a passphrase")
+	}
+	AuditPassphrase = "correct horse"
+	defer func() { AuditPassphrase = "" }()
+	rh, _ = runWarrant(graphs, len(graphs), Warrant{ID: "audit-2", Phone: "1234567890", Telecom: 0, Depth: 0})
+	pubs, _ := filepath.Glob(filepath.Join(dir, "*.audit.pub"))
+	if len(pubs) == 0 {
+		panic("ERROR: no audit key published")
+	}
+	for _, pub := range pubs {
+		public, err := lib.ReadPublicKeys(rh.Suite(), pub)
+		if err != nil {
+			panic("ERROR: could not read audit key: " + err.Error())
+		}
+		path := strings.TrimSuffix(pub, ".pub")
+		l, err := lib.OpenAuditLog(path, rh.Suite(), rh.Suite().Scalar().Pick(random.Stream))
+		if err == nil {
+			l.Close()
+			panic("ERROR: audit log opened with another key")
+		}
+		node := strings.TrimSuffix(filepath.Base(path), ".audit")
+		ring, err := lib.LoadKeyring(rh.Suite(), path+".key", node, AuditPassphrase)
+		if err != nil {
+			panic("ERROR: could not load audit key: " + err.Error())
+		}
+		if !rh.Suite().Point().Mul(nil, ring.Current().SignKey).Equal(public[0]) {
+			panic("ERROR: published audit key does not match the key file")
+		}
+		if _, err := lib.LoadKeyring(rh.Suite(), path+".key", node, "wrong horse"); err == nil {
+			panic("ERROR: audit key stored in the clear")
+		}
+	}
+
+	println("PASS: Protocol audit log test")
+}
+
+// auditorReport waits for the report of the auditor on a warrant
+func auditorReport(warrantID string) *AuditReport {
+	deadline := time.Now().Add(protocolTimeout)
+	for time.Now().Before(deadline) {
+		if report := AuditorReport(warrantID); report != nil {
+			return report
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	panic("ERROR: auditor did not report on " + warrantID)
+}
+
+func TestAuditor(t *testing.T) {
+	SetAuditor(true)
+	defer SetAuditor(false)
+
+	graphs := readGraphs()
+	var publics []abstract.Point
+	_, result := startWarrant(graphs, len(graphs),
+		Warrant{ID: "auditor-1", Phone: "1234567890", Telecom: 0, Depth: 4, MaxFanout: 4},
+		func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			for _, node := range tree.List() {
+				publics = append(publics, node.ServerIdentity.Public)
+			}
+		})
+	if !result.Complete || result.Truncated == 0 {
+		panic("ERROR: protocol incomplete")
+	}
+
+	report := auditorReport("auditor-1")
+	if len(report.Problems) != 0 {
+		panic(fmt.Sprintf("ERROR: auditor found problems: %v", report.Problems))
+	}
+	queries, replies := 0, 0
+	for _, e := range report.Entries {
+		if e.Query != nil {
+			queries++
+		}
+		if e.Reply != nil {
+			replies++
+		}
+	}
+	if queries != result.Queries || replies != result.Replies {
+		panic("ERROR: auditor missed transcripts")
+	}
+
+	// Replies that exceed the warrant or do not match their signature are
+	// found out
+	suite := network.Suite
+	for _, e := range report.Entries {
+		if e.Reply != nil && len(e.Reply.EncPhones) > 0 {
+			e.Reply.Weights[0]++
+			break
+		}
+	}
+	if len(CheckTranscripts(suite, publics, report.Entries)) != 1 {
+		panic("ERROR: altered reply not found out")
+	}
+	entries := append([]TranscriptEntry{}, report.Entries...)
+	for i, e := range entries {
+		if e.Warrant != nil {
+			warrant := *e.Warrant
+			warrant.MaxFanout = 2
+			entries[i].Warrant = &warrant
+		}
+	}
+	if len(CheckTranscripts(suite, publics, entries)) < 2 {
+		panic("ERROR: queries and replies beyond the warrant not found out")
+	}
+
+	// Telecoms without a graph are not queried, and owe no transcripts
+	_, result = runWarrant(graphs, len(graphs)+2,
+		Warrant{ID: "auditor-2", Phone: "1234567890", Telecom: 0, Depth: 2, MaxFanout: 4})
+	if report := auditorReport("auditor-2"); len(report.Problems) != 0 {
+		panic(fmt.Sprintf("ERROR: auditor found problems with extra telecoms: %v", report.Problems))
+	}
+
+	println("PASS: Protocol auditor test")
+}
+
+func TestTransparencyLog(t *testing.T) {
+	suite := network.Suite
+	var keys []abstract.Scalar
+	for i := 0; i < 3; i++ {
+		keys = append(keys, suite.Scalar().Pick(random.Stream))
+	}
+	tlog := lib.NewTransparencyLog(suite, keys)
+	court := suite.Scalar().Pick(random.Stream)
+	SetTransparencyLog(tlog, tlog.Publics, map[string]abstract.Point{"court": suite.Point().Mul(nil, court)})
+	defer SetTransparencyLog(nil, nil, nil)
+
+	graphs := readGraphs()
+	warrant := Warrant{ID: "logged", Phone: "1234567890", Telecom: 0, Depth: 3, Issuer: "court"}
+	if _, err := IssueWarrant(tlog, court, &warrant); err != nil {
+		panic("ERROR: could not issue warrant: " + err.Error())
+	}
+	checkWarrant(graphs, len(graphs), warrant)
+
+	// Warrants missing from the log, logged warrants run with another scope,
+	// and warrants not signed by their issuer are rejected by the telecoms
+	unlogged := Warrant{ID: "secret", Phone: "1234567890", Telecom: 0, Depth: 3, Issuer: "court"}
+	if _, err := IssueWarrant(lib.NewTransparencyLog(suite, keys), court, &unlogged); err != nil {
+		panic("ERROR: could not issue warrant: " + err.Error())
+	}
+	altered := warrant
+	altered.Depth = 4
+	forged := Warrant{ID: "forged", Phone: "1234567890", Telecom: 0, Depth: 3, Issuer: "court"}
+	if _, err := IssueWarrant(tlog, suite.Scalar().Pick(random.Stream), &forged); err != nil {
+		panic("ERROR: could not issue warrant: " + err.Error())
+	}
+	for _, w := range []Warrant{unlogged, altered, forged} {
+		_, result := startWarrant(graphs, len(graphs), w, nil)
+		if result.Complete || len(result.Contacts) != 0 || len(result.Unanswered) != 1 ||
+			!strings.Contains(result.Unanswered[0].Reason, "transparency log") {
+			panic(fmt.Sprintf("ERROR: unlogged warrant executed: %+v", result.Unanswered))
+		}
+	}
+
+	// The agency cannot query another target under the warrant, nor a
+	// number no telecom released
+	for _, id := range []int{1, 2} {
+		var mutex sync.Mutex
+		var agency *PPCC
+		var result *Result
+		tampered(func(msg interface{}) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if q, ok := msg.(*AuthorityQuery); ok && q.ID == id && q.Seq == id {
+				enc, err := agency.ppcc.EncryptTelecomMessage("1234567891", numAuthorities+q.Telecom)
+				if err != nil {
+					panic("ERROR: could not encrypt query: " + err.Error())
+				}
+				q.EncQuery = enc
+				q.Signature = agency.ppcc.SignMessage(q.signedFields())
+			}
+			return true
+		}, func() {
+			_, result = startWarrant(graphs, len(graphs), warrant, func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+				mutex.Lock()
+				agency = rh
+				mutex.Unlock()
+			})
+		})
+		reason := map[int]string{1: "warrant's target", 2: "not released"}[id]
+		found := false
+		for _, q := range result.Unanswered {
+			found = found || strings.Contains(q.Reason, reason)
+		}
+		if result.Complete || !found {
+			panic(fmt.Sprintf("ERROR: query %d for another number answered: %+v", id, result.Unanswered))
+		}
+	}
+
+	// Stale tree heads, and tree heads of a fork of the log, are rejected
+	maxAge := MaxTreeHeadAge
+	MaxTreeHeadAge = 0
+	_, result := startWarrant(graphs, len(graphs), warrant, nil)
+	MaxTreeHeadAge = maxAge
+	if result.Complete || len(result.Unanswered) != 1 || !strings.Contains(result.Unanswered[0].Reason, "old") {
+		panic(fmt.Sprintf("ERROR: stale tree head accepted: %+v", result.Unanswered))
+	}
+
+	// An agency whose tree head ages proves its warrant again, and the heads
+	// too old to be accepted are forgotten but for the largest
+	rh, _ := runWarrant(graphs, len(graphs), warrant)
+	rh.treeHead.Time = time.Now().Add(-maxAge * 3 / 4).UnixNano()
+	rh.refreshProof()
+	if time.Since(time.Unix(0, rh.treeHead.Time)) > maxAge/2 {
+		panic("ERROR: aging tree head not refreshed")
+	}
+	logKeys := []abstract.Point{suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))}
+	old := time.Now().Add(-2 * maxAge).UnixNano()
+	for size := 1; size <= 3; size++ {
+		if err := checkTreeHead(logKeys, lib.SignedTreeHead{Size: size, Root: []byte{byte(size)}, Time: time.Now().UnixNano()}); err != nil {
+			panic("ERROR: tree head rejected: " + err.Error())
+		}
+	}
+	treeHeads.Lock()
+	for _, seen := range treeHeads.bySize[fmt.Sprint(logKeys)] {
+		seen.first, seen.last = old, old
+	}
+	treeHeads.Unlock()
+	if err := checkTreeHead(logKeys, lib.SignedTreeHead{Size: 4, Root: []byte{4}, Time: time.Now().UnixNano()}); err != nil {
+		panic("ERROR: tree head rejected: " + err.Error())
+	}
+	treeHeads.Lock()
+	heads := treeHeads.bySize[fmt.Sprint(logKeys)]
+	if len(heads) != 2 || heads[3] == nil || heads[4] == nil {
+		panic(fmt.Sprintf("ERROR: wrong tree heads kept: %d", len(heads)))
+	}
+	treeHeads.Unlock()
+	fork := lib.NewTransparencyLog(suite, keys)
+	fork.Append(lib.WarrantEntry{Hash: []byte{1}, Issuer: "court"})
+	fork.Append(warrant.Entry())
+	SetTransparencyLog(fork, fork.Publics, map[string]abstract.Point{"court": suite.Point().Mul(nil, court)})
+	_, result = startWarrant(graphs, len(graphs), warrant, nil)
+	if result.Complete || len(result.Unanswered) != 1 || !strings.Contains(result.Unanswered[0].Reason, "tree heads of size") {
+		panic(fmt.Sprintf("ERROR: forked log accepted: %+v", result.Unanswered))
+	}
+
+	println("PASS: Protocol transparency log test")
+}
+
+func TestReplay(t *testing.T) {
+	graphs := readGraphs()
+	warrant := Warrant{ID: "replay-1", Phone: "1234567890", Telecom: 0, Depth: 3}
+	inSession := func(id string) func(*onet.LocalTest, *onet.Tree, *PPCC) {
+		return func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			rh.SessionID = id
+		}
+	}
+	rejected := func(result *Result, reason string) bool {
+		return !result.Complete && len(result.Contacts) == 0 && len(result.Unanswered) == 1 &&
+			strings.Contains(result.Unanswered[0].Reason, reason)
+	}
+
+	_, result := startWarrant(graphs, len(graphs), warrant, inSession("session-1"))
+	if !result.Complete {
+		panic("ERROR: protocol incomplete")
+	}
+
+	// The queries of the first session are replayed, but a new session is
+	// answered
+	_, result = startWarrant(graphs, len(graphs), warrant, inSession("session-1"))
+	if !rejected(result, "replayed") {
+		panic(fmt.Sprintf("ERROR: replayed queries answered: %+v", result.Unanswered))
+	}
+	_, result = startWarrant(graphs, len(graphs), warrant, inSession("session-2"))
+	if !result.Complete {
+		panic("ERROR: new session rejected")
+	}
+
+	// Queries for expired warrants are rejected
+	warrant.ID = "replay-2"
+	warrant.Expires = time.Now().Add(-time.Second).UnixNano()
+	_, result = startWarrant(graphs, len(graphs), warrant, nil)
+	if !rejected(result, "expired") {
+		panic(fmt.Sprintf("ERROR: expired warrant executed: %+v", result.Unanswered))
+	}
+
+	// Without a transparency log, warrants without expiry are rejected
+	warrant.ID = "replay-3"
+	_, result = startWarrant(graphs, len(graphs), warrant, func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+		rh.InitWarrant.Expires = 0
+	})
+	if !rejected(result, "without expiry") {
+		panic(fmt.Sprintf("ERROR: warrant without expiry executed: %+v", result.Unanswered))
+	}
+
+	// With an AuditDir, the replay state survives a restart, until the
+	// warrant expires
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		panic("ERROR: could not create directory: " + err.Error())
+	}
+	defer os.RemoveAll(dir)
+	AuditDir, AuditPassphrase = dir, "correct horse"
+	defer func() { AuditDir, AuditPassphrase = "", "" }()
+	restart := func() {
+		sessions.Lock()
+		sessions.m = make(map[int]map[string]*replayState)
+		sessions.Unlock()
+	}
+	rh, _ := startWarrant(graphs, len(graphs), Warrant{ID: "replay-4", Phone: "1234567890", Telecom: 0, Depth: 0}, nil)
+	query := &AuthorityQuery{WarrantID: "replay-4", SessionID: "session-1", Seq: 1,
+		Expires: time.Now().Add(200 * time.Millisecond).UnixNano()}
+	if err := rh.checkFresh(query); err != nil {
+		panic("ERROR: fresh query rejected: " + err.Error())
+	}
+	restart()
+	if err := rh.checkFresh(query); err == nil || !strings.Contains(err.Error(), "replayed") {
+		panic(fmt.Sprintf("ERROR: query replayed after restart: %v", err))
+	}
+	time.Sleep(300 * time.Millisecond)
+	restart()
+	other := &AuthorityQuery{WarrantID: "replay-5", SessionID: "session-1", Seq: 1,
+		Expires: time.Now().Add(time.Hour).UnixNano()}
+	if err := rh.checkFresh(other); err != nil {
+		panic("ERROR: fresh query rejected: " + err.Error())
+	}
+	prefix, _ := rh.auditPrefix()
+	if files, _ := filepath.Glob(prefix + "-*.replay"); len(files) != 1 {
+		panic(fmt.Sprintf("ERROR: replay state of expired warrant kept: %v", files))
+	}
+	restart()
+
+	println("PASS: Protocol replay test")
+}
+
+func TestKeyrings(t *testing.T) {
+	graphs := readGraphs()
+	suite := network.Suite
+
+	// Every node uses a keyring, the telecoms' rotated with an overlap.  The
+	// agency was created before its keyring was set, so its keys are set up
+	// again.
+	withKeyrings := func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+		for i, node := range tree.List() {
+			ring := lib.NewKeyring(suite, fmt.Sprintf("node%d", i))
+			if i > 0 {
+				ring.Rotate(time.Hour)
+			}
+			if err := SetKeyring(node.ServerIdentity.Public, ring); err != nil {
+				panic("ERROR: could not set keyring: " + err.Error())
+			}
+		}
+		ppcc, err := newCrypto(rh.TreeNodeInstance, rh.publics)
+		if err != nil {
+			panic("ERROR: could not set up keys: " + err.Error())
+		}
+		rh.ppcc = ppcc
+	}
+	var telecom abstract.Point
+	_, result := startWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 3},
+		func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			withKeyrings(local, tree, rh)
+			telecom = tree.List()[numAuthorities].ServerIdentity.Public
+		})
+	if !result.Complete || len(result.Contacts) < 2 {
+		panic("ERROR: protocol with keyrings incomplete")
+	}
+	published, ok := PublishedKeys(telecom)
+	if !ok || len(published.Keys) != 2 || published.Current(time.Now()).Version != 2 {
+		panic("ERROR: wrong published keys")
+	}
+
+	// Keys not signed by a known key of the node are not accepted
+	if PublishKeys(telecom, lib.NewKeyring(suite, "impostor").Publish()) == nil {
+		panic("ERROR: keys of impostor accepted")
+	}
+
+	// Queries signed with a key the agency did not publish are rejected
+	_, result = startWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 3},
+		func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+			withKeyrings(local, tree, rh)
+			keys.Lock()
+			keys.published[rh.Public().String()] = lib.NewKeyring(suite, "other").Publish()
+			keys.Unlock()
+		})
+	if result.Complete || len(result.Unanswered) != 1 ||
+		!strings.Contains(result.Unanswered[0].Reason, "published key") {
+		panic(fmt.Sprintf("ERROR: query with unpublished key answered: %+v", result.Unanswered))
+	}
+
+	println("PASS: Protocol keyrings test")
+}
+
+func TestSuites(t *testing.T) {
+	graphs := readGraphs()
+	defaultSuite := network.Suite
+	defer func() {
+		network.Suite = defaultSuite
+		SetSuite("")
+	}()
+
+	// The whole protocol runs on every suite
+	for _, name := range lib.SuiteNames() {
+		suite, err := lib.SuiteByName(name)
+		if err != nil {
+			panic("ERROR: " + err.Error())
+		}
+		network.Suite = suite
+		if err := SetSuite(name); err != nil {
+			panic("ERROR: could not select suite: " + err.Error())
+		}
+		checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 3})
+	}
+	if SetSuite("P1024") == nil {
+		panic("ERROR: unknown suite selected")
+	}
+
+	// Nodes running another suite than the configured one do not start
+	network.Suite = defaultSuite
+	for _, name := range lib.SuiteNames() {
+		if name != defaultSuite.String() {
+			SetSuite(name)
+			break
+		}
+	}
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(len(graphs)+numAuthorities, true)
+	if _, err := local.CreateProtocol("PPCC", tree); err == nil {
+		panic("ERROR: protocol started with the wrong suite")
+	}
+
+	println("PASS: Protocol suites test")
+}
+
+func TestHardened(t *testing.T) {
+	budget := 300 * time.Millisecond
+	SetHardened(budget)
+	defer SetHardened(0)
+
+	graphs := readGraphs()
+	checkWarrant(graphs, len(graphs), Warrant{Phone: "1234567890", Telecom: 0, Depth: 2})
+
+	// A number that exists and one that does not take the budget alike; the
+	// one that does not is withheld
+	for phone, contacts := range map[string]int{"1234567890": 1, "5550000000": 0} {
+		_, result := runWarrant(graphs, len(graphs), Warrant{Phone: phone, Telecom: 0, Depth: 0})
+		if result.Duration < budget || result.Replies != 1 || len(result.Contacts) != contacts ||
+			(contacts > 0 && result.Contacts[0].ID != phone) {
+			panic(fmt.Sprintf("ERROR: wrong hardened reply for %s after %v", phone, result.Duration))
+		}
+	}
+
+	// With a transparency log, a query that does not decrypt is answered like
+	// an unknown target, not rejected as a query for another target
+	suite := network.Suite
+	tlog := lib.NewTransparencyLog(suite, []abstract.Scalar{suite.Scalar().Pick(random.Stream)})
+	court := suite.Scalar().Pick(random.Stream)
+	SetTransparencyLog(tlog, tlog.Publics, map[string]abstract.Point{"court": suite.Point().Mul(nil, court)})
+	defer SetTransparencyLog(nil, nil, nil)
+	for corrupt, contacts := range map[bool]int{true: 0, false: 1} {
+		warrant := Warrant{ID: fmt.Sprintf("hardened-%v", corrupt), Phone: "1234567890", Telecom: 0, Depth: 0,
+			Issuer: "court"}
+		if _, err := IssueWarrant(tlog, court, &warrant); err != nil {
+			panic("ERROR: could not issue warrant: " + err.Error())
+		}
+		var mutex sync.Mutex
+		var agency *PPCC
+		var publics []abstract.Point
+		var result *Result
+		tampered(func(msg interface{}) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if q, ok := msg.(*AuthorityQuery); ok && corrupt {
+				q.EncQuery = undecryptable(publics[numAuthorities+q.Telecom])
+				q.Signature = agency.ppcc.SignMessage(q.signedFields())
+			}
+			return true
+		}, func() {
+			_, result = startWarrant(graphs, len(graphs), warrant, func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				agency = rh
+				for _, node := range tree.List() {
+					publics = append(publics, node.ServerIdentity.Public)
+				}
+			})
+		})
+		if !result.Complete || len(result.Unanswered) != 0 || result.Duration < budget ||
+			len(result.Contacts) != contacts {
+			panic(fmt.Sprintf("ERROR: wrong hardened reply with a transparency log: %+v", result.Unanswered))
+		}
+	}
+
+	// Answers over the budget go out at its next multiple
+	ms := time.Millisecond
+	for _, c := range []struct{ elapsed, delay time.Duration }{{0, 300 * ms}, {100 * ms, 200 * ms},
+		{300 * ms, 0}, {400 * ms, 200 * ms}, {900 * ms, 0}} {
+		if delay := budgetDelay(c.elapsed, budget); delay != c.delay {
+			panic(fmt.Sprintf("ERROR: answer after %v held back %v instead of %v", c.elapsed, delay, c.delay))
+		}
+	}
+
+	println("PASS: Protocol hardened test")
+}
+
+// undecryptable encrypts for public a point that holds no data
+func undecryptable(public abstract.Point) lib.Ciphertext {
+	suite := network.Suite
+	for {
+		M, _ := suite.Point().Pick(nil, random.Stream)
+		if _, err := M.Data(); err != nil {
+			K, C, _ := lib.PartialElGamalEncrypt(suite, public, M)
+			return lib.Ciphertext{K: []abstract.Point{K}, C: []abstract.Point{C}}
+		}
+	}
+}
+
+func TestCorruptedCiphertexts(t *testing.T) {
+	graphs := readGraphs()
+	warrant := Warrant{Phone: "1234567890", Telecom: 0, Depth: 2}
+	expected := lib.ReferenceChain(graphs, lib.NewPair(warrant.Phone, warrant.Telecom), warrant.Depth, warrant.Kinds)
+
+	// run executes the warrant, corrupting the first message for which
+	// corrupt returns true
+	run := func(corrupt func(msg interface{}, agency *PPCC, publics []abstract.Point) bool) *Result {
+		var mutex sync.Mutex
+		done := false
+		var agency *PPCC
+		var publics []abstract.Point
+		var result *Result
+		tampered(func(msg interface{}) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !done {
+				done = corrupt(msg, agency, publics)
+			}
+			return true
+		}, func() {
+			_, result = startWarrant(graphs, len(graphs), warrant,
+				func(local *onet.LocalTest, tree *onet.Tree, rh *PPCC) {
+					agency = rh
+					for _, node := range tree.List() {
+						publics = append(publics, node.ServerIdentity.Public)
+					}
+				})
+		})
+		if !done {
+			panic("ERROR: nothing corrupted")
+		}
+		return result
+	}
+	corruptQuery := func(msg interface{}, agency *PPCC, publics []abstract.Point) bool {
+		q, ok := msg.(*AuthorityQuery)
+		if ok {
+			q.EncQuery = undecryptable(publics[numAuthorities+q.Telecom])
+			q.Signature = agency.ppcc.SignMessage(q.signedFields())
+		}
+		return ok
+	}
+	failed := func(result *Result, reason string) bool {
+		for _, q := range result.Unanswered {
+			if strings.Contains(q.Reason, reason) {
+				return !result.Complete
+			}
+		}
+		return false
+	}
+
+	// A query that does not decrypt is rejected
+	result := run(corruptQuery)
+	if !failed(result, "could not decrypt query") || len(result.Contacts) != 0 {
+		panic(fmt.Sprintf("ERROR: corrupted query answered: %+v", result.Unanswered))
+	}
+
+	// A reply whose identifier does not decrypt is dropped with its contacts
+	result = run(func(msg interface{}, agency *PPCC, publics []abstract.Point) bool {
+		r, ok := msg.(*Reply)
+		if ok {
+			r.EncQuery = undecryptable(publics[0])
+		}
+		return ok
+	})
+	if !failed(result, "could not decrypt reply") || result.DecryptFailures != 1 || len(result.Contacts) != 0 {
+		panic(fmt.Sprintf("ERROR: corrupted reply accepted: %+v", result.Unanswered))
+	}
+
+	// A corrupted neighbor is rejected by its telecom, and the other
+	// contacts are still found
+	result = run(func(msg interface{}, agency *PPCC, publics []abstract.Point) bool {
+		r, ok := msg.(*Reply)
+		if !ok || len(r.EncPhones) == 0 {
+			return false
+		}
+		telecom, _ := strconv.Atoi(r.Telecoms[0])
+		r.EncPhones[0] = undecryptable(publics[numAuthorities+telecom])
+		return true
+	})
+	if !failed(result, "could not decrypt query") || len(result.Contacts) < 2 {
+		panic(fmt.Sprintf("ERROR: corrupted neighbor not rejected: %+v", result.Unanswered))
+	}
+	for id := range result.IDs() {
+		if !expected[id] {
+			panic("ERROR: garbage contact " + id)
+		}
+	}
+
+	// In hardened mode the corrupted query is answered like an unknown
+	// target, which is withheld
+	SetHardened(50 * time.Millisecond)
+	defer SetHardened(0)
+	result = run(corruptQuery)
+	if !result.Complete || len(result.Unanswered) != 0 || len(result.Contacts) != 0 {
+		panic(fmt.Sprintf("ERROR: hardened telecom rejected corrupted query: %+v", result.Unanswered))
+	}
+
+	println("PASS: Protocol corrupted ciphertexts test")
 }
@@ -0,0 +1,27 @@
+package protocol
+
+import (
+    "sync"
+)
+
+// suppressions counts per telecom of this process how often a protected
+// node was withheld.  The count stays with the telecom, for its auditors.
+var suppressions = struct {
+    sync.Mutex
+    m   map[int]int
+}{m: make(map[int]int)}
+
+// Suppressions returns how often a telecom withheld a protected node
+func Suppressions(telecom int) int {
+    suppressions.Lock()
+    defer suppressions.Unlock()
+    return suppressions.m[telecom]
+}
+
+// suppress counts a protected node withheld by this telecom
+func (p *PPCC) suppress() {
+    p.measure.suppressed++
+    suppressions.Lock()
+    suppressions.m[p.TelecomIdx]++
+    suppressions.Unlock()
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// replayState is what a telecom remembers of a warrant to reject replayed
+// queries: the highest sequence number answered in every session
+type replayState struct {
+    Expires     int64
+    Sessions    map[string]int
+}
+
+// sessions holds per telecom of this process the replay state of every
+// warrant it answered.  Like the ledgers, it outlives protocol instances, so
+// that a query captured in one run cannot be replayed in another.  With an
+// AuditDir, the state of every warrant is also kept in a file next to the
+// node's audit log, so that it survives restarts.  The state of a warrant is
+// dropped once the warrant expires, since its queries are rejected anyway.
+var sessions = struct {
+    sync.Mutex
+    m   map[int]map[string]*replayState
+}{m: make(map[int]map[string]*replayState)}
+
+// checkFresh rejects queries for expired warrants, and queries whose
+// sequence number is not above every one answered before in their session.
+// A warrant needs an expiry, unless the transparency log binds it to its
+// issuer; otherwise the agency could give itself one that never comes.  A
+// fresh query's sequence number is recorded.
+func (p *PPCC) checkFresh(in *AuthorityQuery) error {
+    if in.SessionID == "" {
+        return fmt.Errorf("missing session ID")
+    }
+    if _, keys, _ := transparencyLog(); in.Expires == 0 && len(keys) == 0 {
+        return fmt.Errorf("warrant without expiry")
+    }
+    now := time.Now().UnixNano()
+    if in.Expires != 0 && now > in.Expires {
+        return fmt.Errorf("warrant expired at %v", time.Unix(0, in.Expires))
+    }
+
+    sessions.Lock()
+    defer sessions.Unlock()
+    warrants := sessions.m[p.TelecomIdx]
+    if warrants == nil {
+        warrants = make(map[string]*replayState)
+        sessions.m[p.TelecomIdx] = warrants
+        p.pruneReplayFiles(now)
+    }
+    for id, state := range warrants {
+        if state.Expires != 0 && now > state.Expires {
+            delete(warrants, id)
+            p.removeReplayFile(id)
+        }
+    }
+
+    state := warrants[in.WarrantID]
+    if state == nil {
+        var err error
+        if state, err = p.readReplayFile(in.WarrantID); err != nil {
+            return fmt.Errorf("could not read replay state: %v", err)
+        }
+        if state == nil {
+            state = &replayState{Expires: in.Expires, Sessions: make(map[string]int)}
+        }
+        warrants[in.WarrantID] = state
+    }
+    if in.Expires == 0 || (state.Expires != 0 && in.Expires > state.Expires) {
+        state.Expires = in.Expires
+    }
+    last, ok := state.Sessions[in.SessionID]
+    if ok && in.Seq <= last {
+        return fmt.Errorf("replayed query: sequence number %d not above %d", in.Seq, last)
+    }
+    state.Sessions[in.SessionID] = in.Seq
+    if err := p.writeReplayFile(in.WarrantID, state); err != nil {
+        if ok {
+            state.Sessions[in.SessionID] = last
+        } else {
+            delete(state.Sessions, in.SessionID)
+        }
+        return fmt.Errorf("could not record query: %v", err)
+    }
+    return nil
+}
+
+// replayPath is the file of the replay state of a warrant, or "" without an
+// AuditDir
+func (p *PPCC) replayPath(warrantID string) string {
+    prefix, err := p.auditPrefix()
+    if err != nil || prefix == "" {
+        return ""
+    }
+    h := sha256.Sum256([]byte(warrantID))
+    return fmt.Sprintf("%s-%x.replay", prefix, h[:8])
+}
+
+// readReplayFile returns the replay state of a warrant kept on disk, or nil
+// if there is none
+func (p *PPCC) readReplayFile(warrantID string) (*replayState, error) {
+    path := p.replayPath(warrantID)
+    if path == "" {
+        return nil, nil
+    }
+    buf, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    state := &replayState{}
+    if err := json.Unmarshal(buf, state); err != nil {
+        return nil, fmt.Errorf("malformed replay state %s: %v", path, err)
+    }
+    if state.Sessions == nil {
+        state.Sessions = make(map[string]int)
+    }
+    return state, nil
+}
+
+// writeReplayFile keeps the replay state of a warrant on disk, replacing the
+// file at once so that a crash leaves the old state or the new one
+func (p *PPCC) writeReplayFile(warrantID string, state *replayState) error {
+    path := p.replayPath(warrantID)
+    if path == "" {
+        return nil
+    }
+    buf, err := json.Marshal(state)
+    if err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+func (p *PPCC) removeReplayFile(warrantID string) {
+    if path := p.replayPath(warrantID); path != "" {
+        os.Remove(path)
+    }
+}
+
+// pruneReplayFiles removes the replay state kept on disk of the warrants
+// that expired while the node was not running
+func (p *PPCC) pruneReplayFiles(now int64) {
+    prefix, err := p.auditPrefix()
+    if err != nil || prefix == "" {
+        return
+    }
+    paths, _ := filepath.Glob(prefix + "-*.replay")
+    for _, path := range paths {
+        buf, err := ioutil.ReadFile(path)
+        if err != nil {
+            continue
+        }
+        var state replayState
+        if json.Unmarshal(buf, &state) == nil && state.Expires != 0 && now > state.Expires {
+            os.Remove(path)
+        }
+    }
+}
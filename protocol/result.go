@@ -0,0 +1,200 @@
+package protocol
+
+import (
+    "sort"
+    "time"
+
+    "github.com/hm16083/ppcc/lib"
+)
+
+// Result is sent on ProtocolDone when the agency finishes.  The protocol is
+// Complete if it started and every query was answered.
+type Result struct {
+    Warrant     Warrant
+
+    // Contacts holds the target and every contact found, by hops then ID
+    Contacts    []Contact
+
+    Complete    bool
+    Unanswered  []UnansweredQuery
+    Err         error
+
+    // Exhausted is set when the contact budget of the warrant ran out, and
+    // Truncated counts the replies cut to the fan-out limit
+    Exhausted   bool
+    Truncated   int
+
+    // Graph holds the contacts and the calls revealed among them, when the
+    // warrant asked for the subgraph
+    Graph       *lib.TelecomGraph
+
+    Started     time.Time
+    Duration    time.Duration
+
+    // Queries counts the queries sent, retries included
+    Queries     int
+    Replies     int
+
+    // DecryptFailures counts the replies and calls dropped because they did
+    // not decrypt
+    DecryptFailures int
+
+    index       map[string]int
+    edges       []revealedEdge
+}
+
+// revealedEdge is a call between contacts revealed by a reply
+type revealedEdge struct {
+    from, to    lib.AgencyPair
+    weight      int
+}
+
+// Contact is an identifier revealed by the protocol.  Telecom is the carrier
+// holding the identifier, and Hops its distance from the warrant target.  Via
+// lists the contacts whose neighbor lists revealed it; the target has none.
+// Chain is the chain of contacts from the target through which it was first
+// reached, ending with the contact itself.  Excluded hubs were not chained
+// through.
+type Contact struct {
+    ID          string
+    Kind        lib.IDKind
+    Telecom     int
+    Hops        int
+    Via         []string
+    Chain       []string
+    Excluded    bool
+}
+
+func newResult() *Result {
+    return &Result{index: make(map[string]int)}
+}
+
+// IDs returns the set of identifiers in the result
+func (r *Result) IDs() map[string]bool {
+    ids := make(map[string]bool, len(r.Contacts))
+    for _, c := range r.Contacts {
+        ids[c.ID] = true
+    }
+    return ids
+}
+
+// Contact returns the contact with the given identifier
+func (r *Result) Contact(id string) (*Contact, bool) {
+    i, ok := r.index[id]
+    if !ok {
+        return nil, false
+    }
+    return &r.Contacts[i], true
+}
+
+// Provenance returns the subgraph of the contacts and of the calls through
+// which they were reached, which the graph writers can export
+func (r *Result) Provenance() *lib.TelecomGraph {
+    nodes := make([]lib.AgencyPair, len(r.Contacts))
+    for i, c := range r.Contacts {
+        nodes[i] = lib.NewPair(c.ID, c.Telecom)
+    }
+
+    g := lib.NewGraph(nodes)
+    for i, c := range r.Contacts {
+        for _, via := range c.Via {
+            from, ok := r.Contact(via)
+            if !ok {
+                continue
+            }
+            pair := lib.NewPair(from.ID, from.Telecom)
+            if !g.ContainsEdge(pair, nodes[i]) {
+                g.AddEdge(pair, nodes[i], 1)
+            }
+        }
+    }
+    return g
+}
+
+// addEdge records a call revealed by a reply
+func (r *Result) addEdge(from, to lib.AgencyPair, weight int) {
+    r.edges = append(r.edges, revealedEdge{from, to, weight})
+}
+
+// subgraph builds the graph of the contacts and the calls among them
+func (r *Result) subgraph() *lib.TelecomGraph {
+    nodes := make([]lib.AgencyPair, len(r.Contacts))
+    for i, c := range r.Contacts {
+        nodes[i] = lib.NewPair(c.ID, c.Telecom)
+    }
+
+    // AddEdge skips calls to nodes that are not contacts, which happens when
+    // a query was left unanswered
+    g := lib.NewGraph(nodes)
+    for _, e := range r.edges {
+        if e.from != e.to && !g.ContainsEdge(e.from, e.to) {
+            g.AddEdge(e.from, e.to, e.weight)
+        }
+    }
+    return g
+}
+
+// Hubs returns the identifiers of the contacts excluded as hubs
+func (r *Result) Hubs() []string {
+    var hubs []string
+    for _, c := range r.Contacts {
+        if c.Excluded {
+            hubs = append(hubs, c.ID)
+        }
+    }
+    return hubs
+}
+
+// addContact records a contact reached through the given chain, which ends
+// with the contact itself, and returns it
+func (r *Result) addContact(telecom int, chain []string) *Contact {
+    id := chain[len(chain) - 1]
+    hops := len(chain) - 1
+    i, ok := r.index[id]
+    if !ok {
+        kind, _ := lib.ParseIdentifier(id)
+        r.Contacts = append(r.Contacts, Contact{ID: id, Kind: kind, Telecom: telecom, Hops: hops, Chain: chain})
+        i = len(r.Contacts) - 1
+        r.index[id] = i
+    }
+
+    c := &r.Contacts[i]
+    if hops == 0 || c.Hops == 0 {
+        return c
+    }
+    via := chain[len(chain) - 2]
+    for _, v := range c.Via {
+        if v == via {
+            return c
+        }
+    }
+
+    // Keep the via on a shortest chain first
+    if hops < c.Hops {
+        c.Hops = hops
+        c.Chain = chain
+        c.Via = append([]string{via}, c.Via...)
+    } else {
+        c.Via = append(c.Via, via)
+    }
+    return c
+}
+
+// finish sorts the contacts and sets the summary fields
+func (r *Result) finish() {
+    sort.Slice(r.Contacts, func(i, j int) bool {
+        a, b := r.Contacts[i], r.Contacts[j]
+        if a.Hops != b.Hops {
+            return a.Hops < b.Hops
+        }
+        return a.ID < b.ID
+    })
+    for i, c := range r.Contacts {
+        r.index[c.ID] = i
+    }
+    if r.Warrant.Subgraph {
+        r.Graph = r.subgraph()
+    }
+    r.Duration = time.Since(r.Started)
+    r.Complete = r.Err == nil && len(r.Unanswered) == 0
+}
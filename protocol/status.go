@@ -0,0 +1,34 @@
+package protocol
+
+import (
+    "time"
+
+    "github.com/hm16083/ppcc/lib"
+)
+
+// DefaultQueryTimeout and DefaultRetries are the timeout and retry settings
+// of a new protocol instance
+var DefaultQueryTimeout = 10 * time.Second
+var DefaultRetries = 2
+
+// timeoutTick is how often the agency looks for queries that timed out
+var timeoutTick = 50 * time.Millisecond
+
+// UnansweredQuery is a query the agency gave up on
+type UnansweredQuery struct {
+    ID          int
+    Telecom     int
+    Depth       int
+    Attempts    int
+    Reason      string
+}
+
+// pendingQuery is a query the agency waits on.  Every retry is sent under
+// the ID of the query, which the telecom answers with the reply it sent
+// first, if any.
+type pendingQuery struct {
+    triple      *lib.AgencyTriple
+    id          int
+    attempts    int
+    sentAt      time.Time
+}
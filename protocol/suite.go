@@ -0,0 +1,49 @@
+package protocol
+
+import (
+    "fmt"
+    "reflect"
+
+    "github.com/hm16083/ppcc/lib"
+    "gopkg.in/dedis/onet.v1"
+)
+
+// suiteName is the suite every node has to run; empty accepts the suite of
+// the server
+var suiteName = ""
+
+// SetSuite requires the protocol instances created afterwards to run the
+// named suite, one of lib.SuiteNames(); empty accepts any
+func SetSuite(name string) error {
+    if name != "" {
+        if _, err := lib.SuiteByName(name); err != nil {
+            return err
+        }
+    }
+    suiteName = name
+    return nil
+}
+
+// checkRoster verifies that the node runs the configured suite, and that the
+// key of every node of the tree is a point of that suite
+func checkRoster(n *onet.TreeNodeInstance) error {
+    suite := n.Suite()
+    if suiteName != "" && suite.String() != suiteName {
+        return fmt.Errorf("node runs suite %s instead of %s", suite.String(), suiteName)
+    }
+    pointType := reflect.TypeOf(suite.Point())
+    for i, tn := range n.List() {
+        if reflect.TypeOf(tn.ServerIdentity.Public) != pointType {
+            return fmt.Errorf("node %d has a key outside suite %s", i, suite.String())
+        }
+    }
+    return nil
+}
+
+// checkSuite verifies that a message was sent by a node running our suite
+func (p *PPCC) checkSuite(name string) error {
+    if name != p.Suite().String() {
+        return fmt.Errorf("message in suite %q, node runs %s", name, p.Suite().String())
+    }
+    return nil
+}
@@ -0,0 +1,330 @@
+package protocol
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/hm16083/ppcc/lib"
+    "gopkg.in/dedis/crypto.v0/abstract"
+    "gopkg.in/dedis/crypto.v0/random"
+    "gopkg.in/dedis/onet.v1/log"
+    "gopkg.in/dedis/onet.v1/network"
+)
+
+// WarrantLog is what the agency sees of a transparency log: it finds the
+// entry of a warrant and proves its inclusion under a signed tree head
+type WarrantLog interface {
+    Find(e lib.WarrantEntry) (int, bool)
+    Prove(index int) ([][]byte, lib.SignedTreeHead, error)
+}
+
+// transparency holds the public keys of the nodes running the warrant log
+// and of the warrant issuers, by name, and the log the agency of this
+// process fetches its proofs from.  When the keys are set, the agency
+// attaches to its queries an inclusion proof of the warrant, and the
+// telecoms reject queries whose warrant is not in the log or not signed by
+// its issuer.
+var transparency = struct {
+    sync.Mutex
+    log     WarrantLog
+    keys    []abstract.Point
+    issuers map[string]abstract.Point
+}{}
+
+// SetTransparencyLog makes the protocol instances created afterwards check
+// warrants against a transparency log run by nodes with the given public
+// keys, and issued by one of the issuers; no keys disable the check.  The
+// agency fetches its proofs from l, which only the agency needs.
+func SetTransparencyLog(l WarrantLog, keys []abstract.Point, issuers map[string]abstract.Point) {
+    transparency.Lock()
+    transparency.log = l
+    transparency.keys = keys
+    transparency.issuers = issuers
+    transparency.Unlock()
+}
+
+func transparencyLog() (WarrantLog, []abstract.Point, map[string]abstract.Point) {
+    transparency.Lock()
+    defer transparency.Unlock()
+    return transparency.log, transparency.keys, transparency.issuers
+}
+
+// MaxTreeHeadAge is the age beyond which telecoms reject the tree head of a
+// query, so that an agency cannot keep showing a tree from before a warrant
+// was revoked or the log forked.  The agency fetches a fresh proof once its
+// tree head is half that old.
+var MaxTreeHeadAge = time.Hour
+
+// treeHeadSkew is how far in the future a tree head may be, for clocks that
+// differ
+var treeHeadSkew = time.Minute
+
+// treeHeads holds the tree heads accepted in this process, by log keys and
+// size: the root, and the times of the first and last head seen of that size
+var treeHeads = struct {
+    sync.Mutex
+    bySize  map[string]map[int]*seenHead
+}{bySize: make(map[string]map[int]*seenHead)}
+
+type seenHead struct {
+    root    []byte
+    first   int64
+    last    int64
+}
+
+// IssueWarrant is run by the issuer of a warrant, who alone holds key: it
+// commits to the warrant's target under a fresh salt, signs the warrant and
+// publishes it in the transparency log, returning its index.  The warrant
+// needs an ID; a missing issue time is filled in.
+func IssueWarrant(l *lib.TransparencyLog, key abstract.Scalar, w *Warrant) (int, error) {
+    if w.ID == "" {
+        return 0, errors.New("warrant without an ID")
+    }
+    if w.Issued == 0 {
+        w.Issued = time.Now().UnixNano()
+    }
+    w.Salt = make([]byte, 16)
+    if _, err := rand.Read(w.Salt); err != nil {
+        return 0, err
+    }
+    w.Signature = lib.SchnorrSign(network.Suite, random.Stream, w.Hash(), key)
+    return l.Append(w.Entry()), nil
+}
+
+// targetCommitment commits to the target of a warrant.  The salt keeps the
+// target hidden from the telecoms that see the commitment in queries, and is
+// only sent to the target's telecom.
+func targetCommitment(salt []byte, phone string, telecom int) []byte {
+    h := sha256.Sum256([]byte(fmt.Sprintf("%x|%q|%d", salt, phone, telecom)))
+    return h[:]
+}
+
+// Commitment is the commitment to the warrant's target
+func (w *Warrant) Commitment() []byte {
+    return targetCommitment(w.Salt, w.Phone, w.Telecom)
+}
+
+// Hash commits to every field of the warrant, its target through its
+// commitment
+func (w *Warrant) Hash() []byte {
+    return warrantHash(w.ID, w.Commitment(), w.Depth, w.Kinds, w.Subgraph, w.MaxContacts, w.MaxFanout,
+        w.Issuer, w.Issued, w.Expires)
+}
+
+func warrantHash(id string, commitment []byte, depth int, kinds []lib.IDKind, subgraph bool,
+    maxContacts, maxFanout int, issuer string, issued, expires int64) []byte {
+    h := sha256.Sum256([]byte(fmt.Sprintf("%q|%x|%d|%v|%v|%d|%d|%q|%d|%d", id, commitment, depth, kinds,
+        subgraph, maxContacts, maxFanout, issuer, issued, expires)))
+    return h[:]
+}
+
+// Entry is the record of the warrant in a transparency log.  It shows the
+// warrant's scope but not its target.
+func (w *Warrant) Entry() lib.WarrantEntry {
+    return lib.WarrantEntry{
+        Hash:      w.Hash(),
+        Issuer:    w.Issuer,
+        Scope:     warrantScope(w.ID, w.Depth, w.Kinds, w.Subgraph, w.MaxContacts, w.MaxFanout, w.Expires),
+        Time:      w.Issued,
+        Signature: w.Signature,
+    }
+}
+
+// warrantScope describes what a warrant allows, so that a telecom can
+// rebuild it from a query
+func warrantScope(id string, depth int, kinds []lib.IDKind, subgraph bool, maxContacts, maxFanout int,
+    expires int64) string {
+    return fmt.Sprintf("id %s depth %d kinds %v subgraph %v max contacts %d max fanout %d expires %d",
+        id, depth, kinds, subgraph, maxContacts, maxFanout, expires)
+}
+
+// queryEntry is the log entry of the warrant a query claims to run under,
+// rebuilt from the query
+func (q *AuthorityQuery) queryEntry() lib.WarrantEntry {
+    return lib.WarrantEntry{
+        Hash:      warrantHash(q.WarrantID, q.TargetCommitment, q.WarrantDepth, q.Kinds, q.Subgraph,
+                       q.MaxContacts, q.MaxFanout, q.Issuer, q.Issued, q.Expires),
+        Issuer:    q.Issuer,
+        Scope:     warrantScope(q.WarrantID, q.WarrantDepth, q.Kinds, q.Subgraph, q.MaxContacts, q.MaxFanout, q.Expires),
+        Time:      q.Issued,
+        Signature: q.IssuerSignature,
+    }
+}
+
+// releaseMessage is what a telecom signs when it releases a contact under a
+// warrant, to be queried at the given depth at most
+func releaseMessage(warrantID string, depth, telecom int, encPhone lib.Ciphertext) string {
+    return fmt.Sprintf("%q|%d|%d|%+v", warrantID, depth, telecom, encPhone)
+}
+
+// release signs a neighbor released in reply to a query, if there is a
+// transparency log.  The neighbor is one hop further than the query.
+func (p *PPCC) release(in *AuthorityQuery, telecom int, encPhone lib.Ciphertext) []byte {
+    if _, keys, _ := transparencyLog(); len(keys) == 0 {
+        return nil
+    }
+    return p.ppcc.SignMessage(releaseMessage(in.WarrantID, in.Depth - 1, telecom, encPhone))
+}
+
+// proveWarrant fetches the inclusion proof of the agency's warrant.  An
+// unlogged warrant is still run, and its queries rejected by the telecoms.
+func (p *PPCC) proveWarrant() {
+    l, keys, _ := transparencyLog()
+    if len(keys) == 0 {
+        return
+    }
+    if l == nil {
+        log.Lvl1("No transparency log to prove warrant", p.InitWarrant.ID)
+        return
+    }
+    warrant := p.InitWarrant
+    index, ok := l.Find(warrant.Entry())
+    if !ok {
+        log.Lvl1("Warrant", warrant.ID, "is not in the transparency log")
+        return
+    }
+    proof, head, err := l.Prove(index)
+    if err != nil {
+        log.Error("could not prove warrant inclusion:", err)
+        return
+    }
+    p.logIndex = index
+    p.logProof = proof
+    p.treeHead = head
+}
+
+// refreshProof proves the warrant again under a fresh tree head once the one
+// it was proven under is half as old as telecoms accept, so that a long run
+// is not rejected as stale
+func (p *PPCC) refreshProof() {
+    if p.treeHead.Time == 0 {
+        return
+    }
+    if time.Since(time.Unix(0, p.treeHead.Time)) > MaxTreeHeadAge / 2 {
+        p.proveWarrant()
+    }
+}
+
+// checkWarrantLogged verifies that the warrant of a query is signed by its
+// issuer and in the transparency log, if there is one.  A query for a
+// contact carries the signature of the telecom that released it, for the
+// query's depth at least; a query without one is for the target, which
+// checkTarget verifies once the query is decrypted.
+func (p *PPCC) checkWarrantLogged(in *AuthorityQuery) error {
+    _, keys, issuers := transparencyLog()
+    if len(keys) == 0 {
+        return nil
+    }
+    if in.Depth > in.WarrantDepth {
+        return fmt.Errorf("depth %d beyond the warrant's %d", in.Depth, in.WarrantDepth)
+    }
+    entry := in.queryEntry()
+    issuer, ok := issuers[in.Issuer]
+    if !ok {
+        return fmt.Errorf("unknown issuer %q", in.Issuer)
+    }
+    if err := lib.SchnorrVerify(p.Suite(), entry.Hash, issuer, in.IssuerSignature); err != nil {
+        return fmt.Errorf("warrant not signed by its issuer: %v", err)
+    }
+    if err := lib.VerifyWarrantEntry(p.Suite(), keys, entry, in.LogIndex, in.LogProof, in.TreeHead); err != nil {
+        return err
+    }
+    if err := checkTreeHead(keys, in.TreeHead); err != nil {
+        return err
+    }
+
+    if in.Release == nil {
+        return nil
+    }
+    if in.ReleasedBy < 0 || in.ReleasedBy >= p.NumTelecoms || in.ReleaseKey == nil {
+        return fmt.Errorf("contact released by unknown telecom %d", in.ReleasedBy)
+    }
+    if in.Depth > in.ReleaseDepth {
+        return fmt.Errorf("depth %d beyond the release's %d", in.Depth, in.ReleaseDepth)
+    }
+    msg := releaseMessage(in.WarrantID, in.ReleaseDepth, p.TelecomIdx, in.EncQuery)
+    if err := p.ppcc.VerifyMessage(msg, in.ReleaseKey, in.Release); err != nil {
+        return fmt.Errorf("contact not released by telecom %d: %v", in.ReleasedBy, err)
+    }
+    return checkSigner(p.publics[numAuthorities + in.ReleasedBy], in.ReleaseKey)
+}
+
+// checkTarget verifies that a query without a release is for the target the
+// warrant commits to, if there is a transparency log
+func (p *PPCC) checkTarget(in *AuthorityQuery, nodeQuery string) error {
+    if _, keys, _ := transparencyLog(); len(keys) == 0 || in.Release != nil {
+        return nil
+    }
+    if !bytes.Equal(targetCommitment(in.TargetSalt, nodeQuery, p.TelecomIdx), in.TargetCommitment) {
+        return errors.New("query is not for the warrant's target")
+    }
+    return nil
+}
+
+// checkTreeHead rejects a tree head that is stale, or inconsistent with the
+// heads accepted before: a head of the same size with another root, or one
+// whose log shrank since a larger head was signed.  Both show a forked log.
+func checkTreeHead(keys []abstract.Point, h lib.SignedTreeHead) error {
+    age := time.Since(time.Unix(0, h.Time))
+    if age > MaxTreeHeadAge {
+        return fmt.Errorf("tree head is %v old", age)
+    }
+    if age < -treeHeadSkew {
+        return fmt.Errorf("tree head is %v in the future", -age)
+    }
+
+    treeHeads.Lock()
+    defer treeHeads.Unlock()
+    logID := fmt.Sprint(keys)
+    heads := treeHeads.bySize[logID]
+    if heads == nil {
+        heads = make(map[int]*seenHead)
+        treeHeads.bySize[logID] = heads
+    }
+    pruneTreeHeads(heads)
+    for size, seen := range heads {
+        switch {
+        case size == h.Size && !bytes.Equal(seen.root, h.Root):
+            return fmt.Errorf("two tree heads of size %d", size)
+        case size > h.Size && seen.first < h.Time:
+            return fmt.Errorf("tree head of size %d signed after one of size %d", h.Size, size)
+        case size < h.Size && seen.last > h.Time:
+            return fmt.Errorf("tree head of size %d signed before one of size %d", h.Size, size)
+        }
+    }
+    seen := heads[h.Size]
+    if seen == nil {
+        seen = &seenHead{root: h.Root, first: h.Time, last: h.Time}
+        heads[h.Size] = seen
+    }
+    if h.Time < seen.first {
+        seen.first = h.Time
+    }
+    if h.Time > seen.last {
+        seen.last = h.Time
+    }
+    return nil
+}
+
+// pruneTreeHeads drops the heads last seen longer ago than MaxTreeHeadAge,
+// which would be rejected as stale anyway, except the largest, which still
+// shows a log that shrank
+func pruneTreeHeads(heads map[int]*seenHead) {
+    largest := -1
+    for size := range heads {
+        if size > largest {
+            largest = size
+        }
+    }
+    oldest := time.Now().Add(-MaxTreeHeadAge).UnixNano()
+    for size, seen := range heads {
+        if size != largest && seen.last < oldest {
+            delete(heads, size)
+        }
+    }
+}
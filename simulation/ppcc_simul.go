@@ -1,35 +1,179 @@
 package main
 
 import (
-	//"fmt"
-    //"errors"
-    //"strconv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/BurntSushi/toml"
 	"github.com/hm16083/ppcc/protocol"
 	"github.com/hm16083/ppcc/lib"
 	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1/log"
-	//"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/dedis/onet.v1/network"
 	"gopkg.in/dedis/onet.v1/simul/monitor"
 	"gopkg.in/dedis/onet.v1/simul"
 )
 
 func init() {
 	onet.SimulationRegister("PPCC", NewSimulation)
+
+	// Every node of the simulation reports its measurements to the monitor
+	protocol.RecordMeasure = monitor.RecordSingleMeasure
 }
 
-// ChannelSimulation implements onet.Simulation.
+// Simulation implements onet.Simulation; its fields are read from ppcc.toml.
 type Simulation struct {
 	onet.SimulationBFTree
+
+	// Warrant executed in every round; WarrantKinds restricts chaining to
+	// the named identifier kinds, and WarrantSubgraph also reveals the calls
+	// among the contacts.  Rounds share the contact budget of a WarrantID;
+	// without one, every round gets a fresh budget.  Every round's warrant
+	// expires after WarrantValidity (a duration such as "1h"); it may only be
+	// empty, for no expiry, with a transparency log.
+	// Without a WarrantPhone, the target is the first generated subscriber
+	// when graphs are generated, and 1234567890 otherwise.
+	WarrantID          string
+	WarrantPhone       string
+	WarrantTelecom     int
+	WarrantDepth       int
+	WarrantKinds       []string
+	WarrantSubgraph    bool
+	WarrantMaxContacts int
+	WarrantMaxFanout   int
+	WarrantIssuer      string
+	WarrantValidity    string
+
+	// Cipher suite of every node, one of lib.SuiteNames(); empty keeps the
+	// suite onet was built with
+	CipherSuite string
+
+	// Carrier graphs graph0..graph<Carriers-1> are read from GraphDir in
+	// GraphFormat, or generated when GenerateNodes is set
+	Carriers    int
+	GraphDir    string
+	GraphFormat string
+
+	GenerateNodes             int
+	GenerateDegree            float64
+	GenerateExponent          float64
+	GenerateCommunities       int
+	GenerateCommunityFraction float64
+	GenerateCrossCarrier      float64
+	GenerateSeed              int64
+
+	// Carriers do not chain through the identifiers listed in the HubList
+	// file, nor through nodes with more than HubDegree neighbors
+	HubList   string
+	HubDegree int
+
+	// Carriers never disclose the identifiers listed in the ProtectedList file
+	ProtectedList string
+
+	// Auditor makes the last node of the tree an auditor, which checks the
+	// transcripts of every round and logs the problems it finds
+	Auditor bool
+
+	// Directory where every node keeps its audit log, the key signing it,
+	// encrypted like the node keys, and its public key for the auditors;
+	// empty keeps the logs in memory
+	AuditDir string
+
+	// Number of nodes running the transparency log, in which the issuer
+	// publishes the warrant of every round before it runs; 0 disables the
+	// log.  Log node i signs with the key file log<i>.key of LogKeyDir, and
+	// the issuer with issuer.key, both encrypted like the node keys and read
+	// by the root alone, which runs the log and plays the issuer.  Every node
+	// checks tree heads against the public keys in LogKeyDir/log.pub, and
+	// warrants against the key in LogKeyDir/issuer.pub.  Setup creates the
+	// files missing.
+	TransparencyLogNodes int
+	LogKeyDir            string
+	transparency         *lib.TransparencyLog
+	logKeys              []abstract.Point
+	issuers              map[string]abstract.Point
+	issuerKey            abstract.Scalar
+
+	// Directory of the key files of the nodes, encrypted with KeyPassphrase
+	// or else the PPCC_KEY_PASSPHRASE environment variable; empty gives every
+	// node new keys at every start.  Keys older than KeyRotation (a duration
+	// such as "720h") are rotated at start, the old ones staying valid for
+	// KeyOverlap.
+	KeyDir        string
+	KeyPassphrase string
+	KeyRotation   string
+	KeyOverlap    string
+
+	// Time every telecom spends on a query in hardened mode (a duration such
+	// as "50ms"); empty disables hardened mode
+	HardenedBudget string
+
+	// MeasureBytes reports the bytes every node sends to every other, which
+	// costs a second marshalling of every message
+	MeasureBytes bool
+
+	// Time the agency waits for a reply before resending a query (a
+	// duration such as "10s"), and how often it resends
+	QueryTimeout string
+	QueryRetries int
+
+	// Directory receiving the contacts and provenance graph of every round
+	// (and the generated graphs); empty disables output
+	Output string
 }
 
 // NewSimulation is used internally to register the simulation.
 func NewSimulation(config string) (onet.Simulation, error) {
-	jvs := &Simulation{}
+	jvs := &Simulation{
+		WarrantDepth:    3,
+		Carriers:        3,
+		GraphDir:        "..",
+		GraphFormat:     "tgf",
+		GenerateDegree:  10,
+		LogKeyDir:       "translog",
+		WarrantValidity: "1h",
+		QueryRetries:    protocol.DefaultRetries,
+	}
 	_, err := toml.Decode(config, jvs)
 	if err != nil {
 		return nil, err
 	}
+
+	// Every node of the simulation decodes the configuration.  The suite
+	// comes first, as onet and the keys below use network.Suite.
+	if jvs.CipherSuite != "" {
+		suite, err := lib.SuiteByName(jvs.CipherSuite)
+		if err != nil {
+			return nil, err
+		}
+		network.Suite = suite
+	}
+	if err := protocol.SetSuite(jvs.CipherSuite); err != nil {
+		return nil, err
+	}
+	protocol.SetAuditor(jvs.Auditor)
+	protocol.SetMeasureBytes(jvs.MeasureBytes)
+	if jvs.AuditDir != "" {
+		if err := os.MkdirAll(jvs.AuditDir, 0700); err != nil {
+			return nil, err
+		}
+		protocol.AuditDir = jvs.AuditDir
+		if protocol.AuditPassphrase, err = jvs.passphrase(); err != nil {
+			return nil, err
+		}
+	}
+	var budget time.Duration
+	if jvs.HardenedBudget != "" {
+		if budget, err = time.ParseDuration(jvs.HardenedBudget); err != nil {
+			return nil, fmt.Errorf("invalid HardenedBudget: %v", err)
+		}
+	}
+	protocol.SetHardened(budget)
 	return jvs, nil
 }
 
@@ -41,53 +185,462 @@ func (jvs *Simulation) Setup(dir string, hosts []string) (*onet.SimulationConfig
 	if err != nil {
 		return nil, err
 	}
+	if jvs.TransparencyLogNodes > 0 {
+		if err := jvs.createLogKeys(filepath.Join(dir, jvs.LogKeyDir)); err != nil {
+			return nil, err
+		}
+	}
 	return sim, nil
 }
 
-var initSize int = 5
+// createLogKeys creates the key files of the transparency log's nodes and of
+// the issuer that are missing in dir, and writes their public keys
+func (e *Simulation) createLogKeys(dir string) error {
+	passphrase, err := e.passphrase()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	createKey := func(name string) (abstract.Point, error) {
+		path := filepath.Join(dir, name+".key")
+		ring, err := lib.LoadKeyring(network.Suite, path, name, passphrase)
+		if os.IsNotExist(err) {
+			ring = lib.NewKeyring(network.Suite, name)
+			err = ring.Save(path, passphrase)
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := ring.Current()
+		if key == nil {
+			return nil, fmt.Errorf("no valid key in %s", path)
+		}
+		return key.PublicKey(network.Suite).VerifyKey, nil
+	}
+
+	publics := make([]abstract.Point, e.TransparencyLogNodes)
+	for i := range publics {
+		if publics[i], err = createKey(fmt.Sprintf("log%d", i)); err != nil {
+			return err
+		}
+	}
+	if err := lib.WritePublicKeys(filepath.Join(dir, "log.pub"), publics); err != nil {
+		return err
+	}
+	issuer, err := createKey("issuer")
+	if err != nil {
+		return err
+	}
+	return lib.WritePublicKeys(filepath.Join(dir, "issuer.pub"), []abstract.Point{issuer})
+}
+
+// runLog loads the keys of the transparency log's nodes and of the issuer,
+// and runs the log in this process
+func (e *Simulation) runLog() error {
+	passphrase, err := e.passphrase()
+	if err != nil {
+		return err
+	}
+	loadKey := func(name string, public abstract.Point) (abstract.Scalar, error) {
+		path := filepath.Join(e.LogKeyDir, name+".key")
+		ring, err := lib.LoadKeyring(network.Suite, path, name, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		key := ring.Current()
+		if key == nil || !key.PublicKey(network.Suite).VerifyKey.Equal(public) {
+			return nil, fmt.Errorf("key of %s does not match its public key", path)
+		}
+		return key.SignKey, nil
+	}
+
+	keys := make([]abstract.Scalar, e.TransparencyLogNodes)
+	for i := range keys {
+		if keys[i], err = loadKey(fmt.Sprintf("log%d", i), e.logKeys[i]); err != nil {
+			return err
+		}
+	}
+	if e.issuerKey, err = loadKey("issuer", e.issuers[e.WarrantIssuer]); err != nil {
+		return err
+	}
+	e.transparency = lib.NewTransparencyLog(network.Suite, keys)
+	protocol.SetTransparencyLog(e.transparency, e.logKeys, e.issuers)
+	return nil
+}
+
+// issue plays the issuer of a round's warrant, which it signs and publishes
+// in the transparency log.  The agency only gets the issued warrant.
+func (e *Simulation) issue(warrant *protocol.Warrant) error {
+	_, err := protocol.IssueWarrant(e.transparency, e.issuerKey, warrant)
+	return err
+}
+
+// passphrase returns the passphrase of the key files
+func (e *Simulation) passphrase() (string, error) {
+	passphrase := e.KeyPassphrase
+	if passphrase == "" {
+		passphrase = os.Getenv("PPCC_KEY_PASSPHRASE")
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("no passphrase for the key files")
+	}
+	return passphrase, nil
+}
+
+// Node implements onet.Simulation: it loads the keyring of the node, creating
+// or rotating its keys as needed, publishes its keys, and reads the keys of
+// the transparency log and of the issuer
+func (e *Simulation) Node(config *onet.SimulationConfig) error {
+	if e.KeyDir != "" {
+		if err := e.loadKeyring(config.Server.ServerIdentity.Public); err != nil {
+			return err
+		}
+	}
+	if e.TransparencyLogNodes > 0 {
+		var err error
+		e.logKeys, err = lib.ReadPublicKeys(network.Suite, filepath.Join(e.LogKeyDir, "log.pub"))
+		if err != nil {
+			return err
+		}
+		if len(e.logKeys) != e.TransparencyLogNodes {
+			return fmt.Errorf("%d transparency log keys for %d log nodes", len(e.logKeys), e.TransparencyLogNodes)
+		}
+		issuer, err := lib.ReadPublicKeys(network.Suite, filepath.Join(e.LogKeyDir, "issuer.pub"))
+		if err != nil {
+			return err
+		}
+		if len(issuer) != 1 {
+			return fmt.Errorf("%d issuer keys instead of 1", len(issuer))
+		}
+		e.issuers = map[string]abstract.Point{e.WarrantIssuer: issuer[0]}
+		protocol.SetTransparencyLog(nil, e.logKeys, e.issuers)
+	}
+	return e.SimulationBFTree.Node(config)
+}
+
+// loadKeyring sets the keyring of the node with the given identity from its
+// key file
+func (e *Simulation) loadKeyring(identity abstract.Point) error {
+	passphrase, err := e.passphrase()
+	if err != nil {
+		return err
+	}
+	var rotation, overlap time.Duration
+	if e.KeyRotation != "" {
+		if rotation, err = time.ParseDuration(e.KeyRotation); err != nil {
+			return fmt.Errorf("invalid KeyRotation: %v", err)
+		}
+	}
+	if e.KeyOverlap != "" {
+		if overlap, err = time.ParseDuration(e.KeyOverlap); err != nil {
+			return fmt.Errorf("invalid KeyOverlap: %v", err)
+		}
+	}
+	if err := os.MkdirAll(e.KeyDir, 0700); err != nil {
+		return err
+	}
+
+	node := fmt.Sprintf("%v", identity)
+	path := filepath.Join(e.KeyDir, node+".key")
+	ring, err := lib.LoadKeyring(network.Suite, path, node, passphrase)
+	if os.IsNotExist(err) {
+		ring = lib.NewKeyring(network.Suite, node)
+	} else if err != nil {
+		return err
+	}
+	ring.Prune()
+	current := ring.Current()
+	if current == nil || (rotation > 0 && time.Since(time.Unix(0, current.NotBefore)) > rotation) {
+		ring.Rotate(overlap)
+	}
+	if err := ring.Save(path, passphrase); err != nil {
+		return err
+	}
+	return protocol.SetKeyring(identity, ring)
+}
+
+// warrant builds the warrant described by the configuration
+func (e *Simulation) warrant() (protocol.Warrant, error) {
+	warrant := protocol.Warrant{
+		ID:          e.WarrantID,
+		Phone:       e.WarrantPhone,
+		Telecom:     e.WarrantTelecom,
+		Depth:       e.WarrantDepth,
+		Subgraph:    e.WarrantSubgraph,
+		MaxContacts: e.WarrantMaxContacts,
+		MaxFanout:   e.WarrantMaxFanout,
+		Issuer:      e.WarrantIssuer,
+	}
+	for _, name := range e.WarrantKinds {
+		kind, err := lib.ParseKind(name)
+		if err != nil {
+			return warrant, err
+		}
+		warrant.Kinds = append(warrant.Kinds, kind)
+	}
+	if warrant.Telecom < 0 || warrant.Telecom >= e.Carriers {
+		return warrant, fmt.Errorf("warrant telecom %d out of range", warrant.Telecom)
+	}
+	return warrant, nil
+}
+
+// defaultTarget returns the target of a warrant without a WarrantPhone, and
+// its telecom
+func (e *Simulation) defaultTarget(graphs []*lib.TelecomGraph) (string, int) {
+	if e.GenerateNodes == 0 {
+		return "1234567890", e.WarrantTelecom
+	}
+	phone := lib.GeneratedPhone(0)
+	for i, graph := range graphs {
+		if graph.ContainsNode(lib.NewPair(phone, i)) {
+			return phone, i
+		}
+	}
+	return phone, e.WarrantTelecom
+}
+
+// loadGraphs reads or generates one graph per carrier
+func (e *Simulation) loadGraphs() ([]*lib.TelecomGraph, error) {
+	format, err := lib.ParseGraphFormat(e.GraphFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.GenerateNodes > 0 {
+		graphs, err := lib.GenerateGraphs(lib.GeneratorConfig{
+			Nodes:                e.GenerateNodes,
+			Carriers:             e.Carriers,
+			AvgDegree:            e.GenerateDegree,
+			Exponent:             e.GenerateExponent,
+			Communities:          e.GenerateCommunities,
+			CommunityFraction:    e.GenerateCommunityFraction,
+			CrossCarrierFraction: e.GenerateCrossCarrier,
+			Seed:                 e.GenerateSeed,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if e.Output != "" {
+			if _, err := lib.WriteGraphs(e.Output, graphs, format); err != nil {
+				return nil, err
+			}
+		}
+		return graphs, nil
+	}
+
+	graphs := make([]*lib.TelecomGraph, e.Carriers)
+	for i := range graphs {
+		path := filepath.Join(e.GraphDir, fmt.Sprintf("graph%d.%s", i, format))
+		graphs[i], err = lib.ReadGraphFormat(path, format, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return graphs, nil
+}
+
+// excludeHubs sets the hubs of every carrier
+func (e *Simulation) excludeHubs(graphs []*lib.TelecomGraph) error {
+	var hubs []string
+	if e.HubList != "" {
+		var err error
+		hubs, err = lib.ReadIDList(e.HubList)
+		if err != nil {
+			return err
+		}
+	}
+	for _, graph := range graphs {
+		graph.HubDegree = e.HubDegree
+		graph.ExcludeHubs(hubs)
+	}
+	return nil
+}
+
+// writeOutput stores the contacts of a round, their provenance graph and the
+// subgraph if any.  Contacts are written one "id hops telecom via" line each,
+// where via is a comma-separated list, or "-" for the target; excluded hubs
+// are followed by "hub".
+func (e *Simulation) writeOutput(round int, result *protocol.Result) error {
+	if e.Output == "" {
+		return nil
+	}
+	if err := os.MkdirAll(e.Output, 0755); err != nil {
+		return err
+	}
+
+	lines := make([]string, 0, len(result.Contacts))
+	for _, c := range result.Contacts {
+		via := "-"
+		if len(c.Via) > 0 {
+			via = strings.Join(c.Via, ",")
+		}
+		line := fmt.Sprintf("%s %d %d %s", c.ID, c.Hops, c.Telecom, via)
+		if c.Excluded {
+			line += " hub"
+		}
+		lines = append(lines, line)
+	}
+	path := filepath.Join(e.Output, fmt.Sprintf("round%d.txt", round))
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	// The calls through which the contacts were reached, in GraphFormat
+	format, err := lib.ParseGraphFormat(e.GraphFormat)
+	if err != nil {
+		return err
+	}
+	path = filepath.Join(e.Output, fmt.Sprintf("round%d_provenance.%s", round, format))
+	if err := lib.WriteGraphFormat(path, result.Provenance(), format); err != nil {
+		return err
+	}
+	if result.Graph == nil {
+		return nil
+	}
+	path = filepath.Join(e.Output, fmt.Sprintf("round%d_subgraph.%s", round, format))
+	return lib.WriteGraphFormat(path, result.Graph, format)
+}
 
 // Run implements onet.Simulation.
 func (e *Simulation) Run(config *onet.SimulationConfig) error {
 	size := config.Tree.Size()
 	log.Lvl2("Size is:", size, "rounds:", e.Rounds)
-	for round := 0; round < e.Rounds; round++ {
+	needed := e.Carriers + 1
+	if e.Auditor {
+		needed++
+	}
+	if size < needed {
+		return fmt.Errorf("tree of %d nodes cannot hold an agency, %d carriers and the auditor", size, e.Carriers)
+	}
 
-        // Initialize Queue
-        warrant := protocol.Warrant{"1234567890", 0, 3}
+	warrant, err := e.warrant()
+	if err != nil {
+		return err
+	}
+	if e.TransparencyLogNodes > 0 {
+		if err := e.runLog(); err != nil {
+			return err
+		}
+	}
 
-        // Read in graph files to use in simulation
-        graph0, err0 := lib.ReadGraph("../graph0.tgf")
-        if err0 != nil { return err0 }
-        graph1, err1 := lib.ReadGraph("../graph1.tgf")
-        if err1 != nil { return err1 }
-        graph2, err2 := lib.ReadGraph("../graph2.tgf")
-        if err2 != nil { return err2 }
+	// Read in or generate the graphs to use in simulation, and compute the
+	// output every round has to produce
+	graphs, err := e.loadGraphs()
+	if err != nil {
+		return err
+	}
+	if err := e.excludeHubs(graphs); err != nil {
+		return err
+	}
+	if warrant.Phone == "" {
+		warrant.Phone, warrant.Telecom = e.defaultTarget(graphs)
+	}
+	if e.ProtectedList != "" {
+		protected, err := lib.ReadIDList(e.ProtectedList)
+		if err != nil {
+			return err
+		}
+		for _, graph := range graphs {
+			graph.Protect(protected)
+		}
+	}
+	expected := lib.ReferenceChain(graphs, lib.NewPair(warrant.Phone, warrant.Telecom),
+		warrant.Depth, warrant.Kinds)
 
-        graphArr := [3]lib.TelecomGraph{*graph0, *graph1, *graph2}
-        protocol.SetGraphs(graphArr[:])
+	timeout := protocol.DefaultQueryTimeout
+	if e.QueryTimeout != "" {
+		timeout, err = time.ParseDuration(e.QueryTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid QueryTimeout: %v", err)
+		}
+	}
+
+	var validity time.Duration
+	if e.WarrantValidity != "" {
+		validity, err = time.ParseDuration(e.WarrantValidity)
+		if err != nil {
+			return fmt.Errorf("invalid WarrantValidity: %v", err)
+		}
+	}
+	if validity <= 0 && e.TransparencyLogNodes == 0 {
+		return fmt.Errorf("warrants need a WarrantValidity without a transparency log")
+	}
+
+	for round := 0; round < e.Rounds; round++ {
+
+		// Every round starts from unvisited graphs
+		graphArr := make([]lib.TelecomGraph, len(graphs))
+		for i, graph := range graphs {
+			graph.ResetVisited()
+			graphArr[i] = *graph
+		}
+		protocol.SetGraphs(graphArr)
 
 		log.Lvl1("Starting round", round)
-		round := monitor.NewTimeMeasure("round")
+		measure := monitor.NewTimeMeasure("round")
 		p, err := config.Overlay.CreateProtocol("PPCC", config.Tree, onet.NilServiceID)
 		if err != nil {
 			return err
 		}
 
-        rh := p.(*protocol.PPCC)
-        rh.InitWarrant = warrant
+		// Every round is a new warrant for the transparency log, issued
+		// under its own ID without a WarrantID
+		rh := p.(*protocol.PPCC)
+		rh.InitWarrant = warrant
+		if rh.InitWarrant.ID == "" {
+			rh.InitWarrant.ID = fmt.Sprintf("round%d-%d", round, time.Now().UnixNano())
+		}
+		if validity > 0 {
+			rh.InitWarrant.Expires = time.Now().Add(validity).UnixNano()
+		}
+		if e.transparency != nil {
+			if err := e.issue(&rh.InitWarrant); err != nil {
+				return fmt.Errorf("round %d: could not issue warrant: %v", round, err)
+			}
+		}
+		rh.QueryTimeout = timeout
+		rh.MaxRetries = e.QueryRetries
 
 		go p.Start()
-        done := <-rh.ProtocolDone
-		round.Record()
+		result := <-rh.ProtocolDone
+		measure.Record()
 
-        if done {
-            log.Lvl1("Terminated successfully, output list: ", rh.OutputList)
-        } else {
-            log.Lvl1("ERROR: ProtocolDone returned false")
-        }
-    }
+		if result.Err != nil {
+			return fmt.Errorf("round %d: %v", round, result.Err)
+		}
+		if err := e.writeOutput(round, result); err != nil {
+			return err
+		}
+		if !result.Complete {
+			for _, q := range result.Unanswered {
+				log.Lvl1("ERROR: query", q.ID, "to telecom", q.Telecom, "unanswered:", q.Reason)
+			}
+			return fmt.Errorf("round %d: %d queries unanswered", round, len(result.Unanswered))
+		}
+		log.Lvl1("Terminated successfully with", len(result.Contacts), "contacts after",
+			result.Queries, "queries in", result.Duration)
+		if result.DecryptFailures > 0 {
+			log.Lvl1("Dropped", result.DecryptFailures, "calls that did not decrypt")
+		}
+
+		// A budget cuts the output short of the reference
+		if result.Exhausted || result.Truncated > 0 {
+			log.Lvl1("Budget limited the output: exhausted", result.Exhausted, "truncated replies", result.Truncated)
+			for id := range result.IDs() {
+				if !expected[id] {
+					return fmt.Errorf("round %d: unexpected contact %s", round, id)
+				}
+			}
+			continue
+		}
+		if err := lib.CheckOutput(expected, result.IDs()); err != nil {
+			return fmt.Errorf("round %d: %v", round, err)
+		}
+	}
 
-    log.Lvl3("Exiting Run()")
+	log.Lvl3("Exiting Run()")
 	return nil
 }
 